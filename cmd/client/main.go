@@ -22,8 +22,11 @@ import (
 )
 
 var (
-	ip   = flag.String("ip", "127.0.0.1", "input the server IP")
-	port = flag.String("port", "7714", "input the server port")
+	ip     = flag.String("ip", "127.0.0.1", "input the server IP")
+	port   = flag.String("port", "7714", "input the server port")
+	id     = flag.String("id", "", "input the identity to authenticate with")
+	secret = flag.String("secret", "sample_secret", "input the secret or password to authenticate with")
+	token  = flag.String("token", "", "input the token to authenticate with, it overrides the identity and secret")
 )
 
 func init() {
@@ -45,7 +48,13 @@ func main() {
 			return net.Dial("tcp", fmt.Sprintf("%s:%s", *ip, *port))
 		},
 	)
-	client.Connect()
+	if len(*token) > 0 {
+		client.SetCredentials(internal.TokenCredentials(*token))
+	} else {
+		client.SetCredentials(*id, []byte(*secret))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	client.ConnectContext(ctx)
 	client.Label(label)
 
 	// terminal
@@ -55,21 +64,30 @@ func main() {
 	}
 	defer terminal.Close()
 
-	ctx, cancel := context.WithCancel(context.Background())
-
 	roll, err := text.New(text.RollContent(), text.WrapAtWords())
 	if err != nil {
 		logger.Panic("failed to create roll widget")
 	}
 	go func() {
 		for {
-			if l, messages := client.Receive(); l == label {
-				for _, message := range messages {
-					err := roll.Write(fmt.Sprintf("[%s]%s\n", time.Now().Format("15:04:05"), message))
+			msg, err := client.ReceiveMessage()
+			if err != nil {
+				return
+			}
+			if msg.Label == label {
+				at := msg.Time
+				if at.IsZero() {
+					at = time.Now()
+				}
+				for _, message := range msg.Data {
+					err := roll.Write(fmt.Sprintf("[%s]%s\n", at.Format("15:04:05"), message))
 					if err != nil {
 						logger.Panic("failed to write message into the roll widget")
 					}
 				}
+				if msg.Seq > 0 {
+					client.Ack(label, msg.Seq)
+				}
 			}
 		}
 	}()
@@ -118,6 +136,7 @@ func main() {
 	if err := termdash.Run(ctx, terminal, container); err != nil {
 		logger.Panic("failed to run terminal")
 	}
+	client.Close()
 }
 
 var getRandomName = func() func() string {
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/NanoRed/lim/internal"
+)
+
+var (
+	addr    = flag.String("addr", "127.0.0.1:7717", "input the address of the server's admin API")
+	token   = flag.String("token", "", "input the bearer token of the admin API")
+	jsonOut = flag.Bool("json", false, "print JSON instead of tables")
+)
+
+const usage = `usage: limctl [flags] <command> [arguments]
+
+commands:
+  conns                      list the connections
+  labels                     list the labels with their members
+  kick <id> [reason]         close a connection
+  ban <id> [reason]          refuse the identity of a connection and kick it
+  unban <identity>           accept the identity again
+  bans                       list the banned identities
+  publish <label> <message>  multicast a message to a label
+  tail <label>               print the messages of a label or pattern until interrupted
+  stats                      print the server counters
+  passwd <user>              print the password file line of the password read from stdin
+
+flags:
+`
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	args := flag.Args()
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err := run(args[0], args[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "limctl: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(command string, args []string) error {
+	switch command {
+	case "conns":
+		var conns []*internal.ConnStat
+		if err := get("/connections", &conns); err != nil {
+			return err
+		}
+		return output(conns, func(w io.Writer) {
+			fmt.Fprintln(w, "ID\tREMOTE\tIDENTITY\tTRANSPORT\tCONNECTED\tIN\tOUT\tLABELS")
+			for _, c := range conns {
+				fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%d\t%d\t%s\n", c.ID, c.RemoteAddr, c.Identity, c.Transport,
+					c.Connected.Format(time.RFC3339), c.BytesIn, c.BytesOut, strings.Join(c.Labels, ","))
+			}
+		})
+	case "labels":
+		var labels []*internal.LabelStat
+		if err := get("/labels", &labels); err != nil {
+			return err
+		}
+		return output(labels, func(w io.Writer) {
+			fmt.Fprintln(w, "LABEL\tMEMBERS")
+			for _, l := range labels {
+				fmt.Fprintf(w, "%s\t%d\n", l.Label, l.Members)
+			}
+		})
+	case "kick", "ban":
+		if len(args) < 1 {
+			return fmt.Errorf("%s needs a connection id", command)
+		}
+		var ban struct {
+			Identity string `json:"identity"`
+		}
+		values := url.Values{"id": {args[0]}, "reason": {strings.Join(args[1:], " ")}}
+		if err := post("/"+command, values, nil, &ban); err != nil {
+			return err
+		}
+		if command == "ban" && !*jsonOut {
+			fmt.Printf("banned %s\n", ban.Identity)
+		}
+		return nil
+	case "unban":
+		if len(args) != 1 {
+			return errors.New("unban needs an identity")
+		}
+		return post("/unban", url.Values{"identity": {args[0]}}, nil, nil)
+	case "bans":
+		bans := make(map[string]string)
+		if err := get("/bans", &bans); err != nil {
+			return err
+		}
+		return output(bans, func(w io.Writer) {
+			identities := make([]string, 0, len(bans))
+			for identity := range bans {
+				identities = append(identities, identity)
+			}
+			sort.Strings(identities)
+			fmt.Fprintln(w, "IDENTITY\tREASON")
+			for _, identity := range identities {
+				fmt.Fprintf(w, "%s\t%s\n", identity, bans[identity])
+			}
+		})
+	case "publish":
+		if len(args) < 2 {
+			return errors.New("publish needs a label and a message")
+		}
+		return post("/publish", url.Values{"label": {args[0]}}, strings.NewReader(strings.Join(args[1:], " ")), nil)
+	case "tail":
+		if len(args) != 1 {
+			return errors.New("tail needs a label or pattern")
+		}
+		return tail(args[0])
+	case "stats":
+		var stat internal.ServerStat
+		if err := get("/stats", &stat); err != nil {
+			return err
+		}
+		return output(&stat, func(w io.Writer) {
+			transports := make([]string, 0, len(stat.Connections))
+			for transport := range stat.Connections {
+				transports = append(transports, transport)
+			}
+			sort.Strings(transports)
+			fmt.Fprintf(w, "uptime\t%s\n", time.Duration(stat.Uptime*float64(time.Second)).Round(time.Second))
+			for _, transport := range transports {
+				fmt.Fprintf(w, "connections (%s)\t%d\n", transport, stat.Connections[transport])
+			}
+			fmt.Fprintf(w, "labels\t%d\n", stat.Labels)
+			fmt.Fprintf(w, "bans\t%d\n", stat.Bans)
+			fmt.Fprintf(w, "frames in / out\t%d / %d\n", stat.FramesIn, stat.FramesOut)
+			fmt.Fprintf(w, "bytes in / out\t%d / %d\n", stat.BytesIn, stat.BytesOut)
+			fmt.Fprintf(w, "handshake failures\t%d\n", stat.HandshakeFailures)
+			fmt.Fprintf(w, "write timeouts\t%d\n", stat.WriteTimeouts)
+			fmt.Fprintf(w, "dropped frames\t%d\n", stat.Dropped)
+		})
+	case "passwd":
+		if len(args) != 1 || strings.Contains(args[0], ":") {
+			return errors.New("passwd needs a user without colons")
+		}
+		password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		hash, err := internal.HashPassword([]byte(strings.TrimRight(password, "\r\n")))
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s:%s\n", args[0], hash)
+		return nil
+	default:
+		return fmt.Errorf("unknown command %q, see limctl -h", command)
+	}
+}
+
+// output write v as JSON, or the table written by table
+func output(v any, table func(w io.Writer)) error {
+	if *jsonOut {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.SetEscapeHTML(false)
+		return encoder.Encode(v)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	table(w)
+	return w.Flush()
+}
+
+func tail(label string) error {
+	req, err := request(http.MethodGet, "/tail", url.Values{"label": {label}}, nil)
+	if err != nil {
+		return err
+	}
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	resp, err := do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	go func() {
+		<-interrupt
+		resp.Body.Close()
+	}()
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(nil, int(internal.MaxPayloadSize)*2)
+	for scanner.Scan() {
+		if *jsonOut {
+			fmt.Println(scanner.Text())
+			continue
+		}
+		msg := &internal.Message{}
+		if err := json.Unmarshal(scanner.Bytes(), msg); err != nil {
+			return err
+		}
+		from := msg.SenderUser
+		if len(from) == 0 {
+			from = fmt.Sprintf("#%d", msg.SenderConn)
+		}
+		for _, data := range msg.Data {
+			fmt.Printf("%s %s %d %s: %s\n", msg.Time.Format(time.TimeOnly), msg.Label, msg.Seq, from, data)
+		}
+	}
+	return nil
+}
+
+func get(path string, v any) error {
+	req, err := request(http.MethodGet, path, nil, nil)
+	if err != nil {
+		return err
+	}
+	return call(req, v)
+}
+
+func post(path string, values url.Values, body io.Reader, v any) error {
+	req, err := request(http.MethodPost, path, values, body)
+	if err != nil {
+		return err
+	}
+	return call(req, v)
+}
+
+func request(method, path string, values url.Values, body io.Reader) (*http.Request, error) {
+	u := url.URL{Scheme: "http", Host: *addr, Path: path, RawQuery: values.Encode()}
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if len(*token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+*token)
+	}
+	return req, nil
+}
+
+// do send the request, a failed one returns the message of the server as the error
+func do(req *http.Request) (*http.Response, error) {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		defer resp.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
+
+func call(req *http.Request, v any) error {
+	resp, err := do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if v == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
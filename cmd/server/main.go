@@ -1,10 +1,17 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/NanoRed/lim/internal"
+	"github.com/NanoRed/lim/pkg/logger"
 )
 
 var (
@@ -13,13 +20,121 @@ var (
 	wssPort  = flag.String("wssPort", "7715", "input the SSL websocket server port")
 	certFile = flag.String("cert", "/etc/letsencrypt/live/wizard.red/fullchain.pem", "input the SSL certificate path")
 	keyFile  = flag.String("key", "/etc/letsencrypt/live/wizard.red/privkey.pem", "input the SSL key path")
+	secret   = flag.String("secret", "sample_secret", "input the secret shared by the clients")
+	tokenKey = flag.String("tokenKey", "", "input the key signing the client tokens, it overrides the secret")
+	userFile = flag.String("userFile", "", "input the password file of the users, it overrides the token key")
+	clearKey = flag.Bool("clearSecret", false, "accept the clear secrets of the clients without the challenge handshake, which can be replayed")
+	history  = flag.Int("history", 100, "input the number of messages kept for every label, 0 disables the history")
+	ttl      = flag.Duration("historyTTL", time.Hour*24, "input how long a message is kept in the history")
+	journal  = flag.String("journal", "", "input the directory of the message logs, empty disables the logs")
+	maxBytes = flag.Int64("journalBytes", 1<<30, "input the maximum bytes of the log of every label")
+	maxAge   = flag.Duration("journalAge", time.Hour*24*7, "input how long a message is kept in the logs")
+	nodeName = flag.String("node", "", "input the unique name of this node, empty disables the cluster mode")
+	nodePort = flag.String("nodePort", "7716", "input the port for the peer nodes")
+	peers    = flag.String("peers", "", "input the addresses of the peer nodes, separated by commas")
+	nodeKey  = flag.String("nodeSecret", "", "input the secret shared by the nodes, required by the cluster mode")
+	policy   = flag.String("policy", "", "input the label access policy file, empty allows everything")
+	metrics  = flag.String("metrics", "", "input the address of the metrics endpoint, empty disables it")
+	admin    = flag.String("admin", "", "input the address of the admin API (limctl uses 127.0.0.1:7717), empty disables it")
+	adminKey = flag.String("adminToken", "", "input the bearer token of the admin API, empty requires none")
+	grace    = flag.Duration("sessionGrace", time.Second*30, "input how long the session of a broken connection is kept, 0 disables the sessions")
+	backlog  = flag.Int("sessionBacklog", 256, "input the number of frames kept for resuming a session")
+	queue    = flag.Int("queue", internal.SendQueueSize, "input the number of frames queued for every connection")
+	slow     = flag.String("slow", "oldest", "input what to do with a full queue: oldest, newest (drop) or disconnect")
 )
 
 func main() {
 	flag.Parse()
 
 	server := internal.NewServer()
+	reloads := make(map[string]func() error) // reloaded on SIGHUP
+	switch {
+	case len(*userFile) > 0:
+		auth, err := internal.NewPasswordFileAuthenticator(*userFile)
+		if err != nil {
+			logger.Panic("failed to load the password file: %v", err)
+		}
+		server.SetAuthenticator(auth)
+		reloads["password file"] = auth.Reload
+	case len(*tokenKey) > 0:
+		server.SetAuthenticator(internal.NewTokenAuthenticator([]byte(*tokenKey)))
+	default:
+		server.SetAuthenticator(internal.NewStaticSecretAuthenticator([]byte(*secret)))
+	}
+	if *clearKey {
+		server.EnableClearSecrets()
+	}
+	if len(*policy) > 0 {
+		p, err := internal.NewPolicy(*policy)
+		if err != nil {
+			logger.Panic("failed to load the policy file: %v", err)
+		}
+		server.SetPolicy(p)
+		reloads["policy file"] = p.Reload
+	}
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGHUP)
+		for range signals {
+			for name, reload := range reloads {
+				if err := reload(); err != nil {
+					logger.Error("failed to reload the %s: %v", name, err)
+				}
+			}
+		}
+	}()
+	switch *slow {
+	case "oldest":
+		server.SetSendQueue(*queue, internal.QueueDropOldest)
+	case "newest":
+		server.SetSendQueue(*queue, internal.QueueDropNewest)
+	case "disconnect":
+		server.SetSendQueue(*queue, internal.QueueDisconnect)
+	default:
+		logger.Panic("unknown slow consumer policy: %s", *slow)
+	}
+	if *history > 0 {
+		server.EnableHistory(*history, *ttl)
+	}
+	if len(*journal) > 0 {
+		if err := server.EnableJournal(*journal, *maxBytes, *maxAge); err != nil {
+			logger.Panic("failed to open the message logs: %v", err)
+		}
+	}
+	if len(*nodeName) > 0 {
+		var addrs []string
+		if len(*peers) > 0 {
+			addrs = strings.Split(*peers, ",")
+		}
+		if err := server.EnableCluster(*nodeName, fmt.Sprintf("%s:%s", *ip, *nodePort), addrs, []byte(*nodeKey)); err != nil {
+			logger.Panic("failed to enable the cluster mode: %v", err)
+		}
+	}
+	if *grace > 0 {
+		server.EnableSessions(*grace, *backlog)
+	}
+	if len(*metrics) > 0 {
+		server.EnableMetrics(*metrics)
+	}
+	if len(*admin) > 0 {
+		server.EnableAdmin(*admin, *adminKey)
+	}
 	server.EnableWSS(fmt.Sprintf("%s:%s", *ip, *wssPort), *certFile, *keyFile)
 	server.EnableWebsite(fmt.Sprintf("%s:443", *ip), *certFile, *keyFile)
-	server.ListenAndServe(fmt.Sprintf("%s:%s", *ip, *port))
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			logger.Error("failed to shut down gracefully: %v", err)
+		}
+	}()
+	if err := server.ListenAndServe(fmt.Sprintf("%s:%s", *ip, *port)); err != internal.ErrServerClosed {
+		logger.Panic("failed to serve: %v", err)
+	}
+	<-stopped
 }
@@ -12,7 +12,8 @@ import (
 )
 
 var (
-	addr string = "wss://127.0.0.1:7715/"
+	addr   string = "wss://127.0.0.1:7715/"
+	secret string = "sample_secret"
 )
 
 func init() {
@@ -101,6 +102,7 @@ func main() {
 			return conn1, nil
 		},
 	)
+	client.SetCredentials("", []byte(secret))
 	wg := &sync.WaitGroup{}
 	connected := make(chan struct{}, 1)
 	// func: lim_websocket_connect
@@ -122,7 +124,7 @@ func main() {
 		if len(args) > 0 && args[0].Type() == js.TypeString {
 			wg.Wait()
 			label := string(jsStringToGoBytes(args[0]))
-			if err := client.Label(label); err != nil {
+			if err := client.LabelSince(label, 0); err != nil {
 				logger.Error("label failed: %v", err)
 			} else {
 				logger.Info("label successfully: %s", label)
@@ -208,7 +210,10 @@ func main() {
 	// invoke: lim_websocket_onreceive
 	go func() {
 		for {
-			label, messages := client.Receive()
+			label, messages, err := client.Receive()
+			if err != nil {
+				return
+			}
 			if fn := js.Global().Get("lim_websocket_onreceive"); fn.Type() == js.TypeFunction {
 				for _, message := range messages {
 					jsArray := js.Global().Get("Uint8Array").New(len(message))
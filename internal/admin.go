@@ -0,0 +1,421 @@
+package internal
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/NanoRed/lim/internal/protocol"
+	"github.com/NanoRed/lim/pkg/logger"
+)
+
+// AdminIdentity the sender of the messages published through the admin API
+const AdminIdentity = "@admin"
+
+// ConnStat a snapshot of a live connection
+type ConnStat struct {
+	ID         uint64    `json:"id"`
+	RemoteAddr string    `json:"remote_addr"`
+	Identity   string    `json:"identity"`
+	Transport  string    `json:"transport"`
+	Labels     []string  `json:"labels"`
+	Connected  time.Time `json:"connected"`
+	BytesIn    uint64    `json:"bytes_in"`
+	BytesOut   uint64    `json:"bytes_out"`
+}
+
+// LabelStat a label or pattern with the number of its members
+type LabelStat struct {
+	Label   string `json:"label"`
+	Members int    `json:"members"`
+}
+
+// ServerStat the counters of the server since it started
+type ServerStat struct {
+	Uptime            float64        `json:"uptime_seconds"`
+	Connections       map[string]int `json:"connections"` // by transport
+	Labels            int            `json:"labels"`
+	Bans              int            `json:"bans"`
+	FramesIn          uint64         `json:"frames_in"`
+	FramesOut         uint64         `json:"frames_out"`
+	BytesIn           uint64         `json:"bytes_in"`
+	BytesOut          uint64         `json:"bytes_out"`
+	HandshakeFailures uint64         `json:"handshake_failures"`
+	WriteTimeouts     uint64         `json:"write_timeouts"`
+	Dropped           uint64         `json:"dropped_frames"`
+}
+
+// Connections the welcomed connections ordered by id
+func (s *Server) Connections() (stats []*ConnStat) {
+	stats = make([]*ConnStat, 0)
+	s.conns.Range(func(key, value any) bool {
+		if conn := key.(*conn); conn.welcomed() {
+			labels := s.registry.joined(conn)
+			sort.Strings(labels)
+			stats = append(stats, &ConnStat{
+				ID:         conn.id,
+				RemoteAddr: conn.RemoteAddr().String(),
+				Identity:   conn.identity.ID,
+				Transport:  conn.transport,
+				Labels:     labels,
+				Connected:  conn.connected,
+				BytesIn:    atomic.LoadUint64(&conn.bytesIn),
+				BytesOut:   atomic.LoadUint64(&conn.bytesOut),
+			})
+		}
+		return true
+	})
+	sort.Slice(stats, func(i, j int) bool { return stats[i].ID < stats[j].ID })
+	return
+}
+
+// Labels the labels and patterns with members ordered by name
+func (s *Server) Labels() (stats []*LabelStat) {
+	stats = make([]*LabelStat, 0)
+	labels := s.registry.labels()
+	sort.Strings(labels)
+	for _, label := range labels {
+		stats = append(stats, &LabelStat{label, s.registry.size(label)})
+	}
+	return
+}
+
+// Stats sum up the metrics
+func (s *Server) Stats() *ServerStat {
+	m := s.metrics
+	stat := &ServerStat{
+		Uptime:            time.Since(s.started).Seconds(),
+		Connections:       s.transports(),
+		Labels:            len(s.registry.labels()),
+		HandshakeFailures: atomic.LoadUint64(&m.handshakeFailures),
+		WriteTimeouts:     atomic.LoadUint64(&m.writeTimeouts),
+		Dropped:           atomic.LoadUint64(&m.dropped),
+	}
+	s.bans.Range(func(key, value any) bool {
+		stat.Bans++
+		return true
+	})
+	for act := range m.framesIn {
+		stat.FramesIn += atomic.LoadUint64(&m.framesIn[act])
+		stat.FramesOut += atomic.LoadUint64(&m.framesOut[act])
+		stat.BytesIn += atomic.LoadUint64(&m.bytesIn[act])
+		stat.BytesOut += atomic.LoadUint64(&m.bytesOut[act])
+	}
+	return stat
+}
+
+// Kick close the connection, a v2 connection is told the reason first
+func (s *Server) Kick(id uint64, reason string) error {
+	conn, err := s.registry.conn(id)
+	if err != nil {
+		return err
+	}
+	conn.goodbye(reason)
+	ctx, cancel := context.WithTimeout(context.Background(), ConnWriteTimeout)
+	defer cancel()
+	conn.flush(ctx)
+	s.remove(conn)
+	return nil
+}
+
+// Ban refuse the identity of the connection until Unban, and kick every connection of it
+func (s *Server) Ban(id uint64, reason string) (identity string, err error) {
+	target, err := s.registry.conn(id)
+	if err != nil {
+		return
+	}
+	identity = target.identity.ID
+	s.bans.Store(identity, reason)
+	var conns []*conn
+	if pool, err := s.registry.user(identity); err == nil {
+		for current := pool.Entry(); current != nil; current = current.Next() {
+			conns = append(conns, current.Load().(*conn))
+		}
+	}
+	for _, conn := range conns {
+		s.Kick(conn.id, "banned: "+reason)
+	}
+	return
+}
+
+func (s *Server) Unban(identity string) error {
+	if _, ok := s.bans.LoadAndDelete(identity); !ok {
+		return fmt.Errorf("identity is not banned: %s", identity)
+	}
+	return nil
+}
+
+// Bans the banned identities with the reasons
+func (s *Server) Bans() map[string]string {
+	bans := make(map[string]string)
+	s.bans.Range(func(key, value any) bool {
+		bans[key.(string)] = value.(string)
+		return true
+	})
+	return bans
+}
+
+// Publish multicast the data to the label as AdminIdentity, without asking the policy or the hooks
+func (s *Server) Publish(label string, data []byte) error {
+	if len(label) == 0 || isPattern(label) {
+		return errors.New("invalid label")
+	}
+	if s.closing() {
+		return ErrServerClosed
+	}
+	from := &conn{
+		identity: &Identity{ID: AdminIdentity},
+		welcome:  protocol.Welcome{Version: protocol.V2, MaxPayload: MaxPayloadSize},
+	}
+	frame := &protocol.Frame{Act: protocol.ActMulticast, Label: label, Payload: append([]byte{0}, data...)}
+	if len(frame.Payload) > int(MaxPayloadSize) {
+		return errors.New("payload is too large")
+	}
+	return s.multicast(frame, from)
+}
+
+// Tail call f with every message multicast to the label or pattern until ctx is done,
+// the connection is kicked, the server shuts down or f fails. The messages wait in a
+// send queue like the ones of a connection
+func (s *Server) Tail(ctx context.Context, label string, f func(msg *Message) error) error {
+	if len(label) == 0 {
+		return errors.New("invalid label")
+	}
+	local, remote := net.Pipe()
+	defer remote.Close()
+	conn := newConn(local)
+	conn.transport, conn.metrics, conn.connected = TransportAdmin, s.metrics, time.Now()
+	conn.identity = &Identity{ID: AdminIdentity}
+	conn.welcome = protocol.Welcome{Version: protocol.V2, MaxPayload: MaxPayloadSize}
+	if !s.enter(&s.handlers) {
+		conn.Close()
+		return ErrServerClosed
+	}
+	defer s.handlers.Done()
+	s.conns.Store(conn, struct{}{})
+	defer s.remove(conn)
+	conn.serve(s.queueSize, s.queuePolicy)
+	s.registry.register(conn)
+	atomic.StoreUint32(&conn.greeted, 1)
+	if err := s.registry.label(conn, label); err != nil {
+		return err
+	}
+
+	messages := make(chan *Message)
+	go func() {
+		defer close(messages)
+		processor := protocol.NewFrameProcessor(remote)
+		processor.SetVersion(protocol.V2)
+		packer := protocol.NewPacker(func() *protocol.Frame {
+			for {
+				frame := protocol.NewFrame()
+				if _, err := processor.Decode(frame); err != nil || frame.Act == protocol.ActClose {
+					runtime.Goexit() // the pipe is closed, or the connection is kicked
+				}
+				if frame.Act == protocol.ActMulticast && len(frame.Payload) > 0 {
+					return frame
+				}
+				frame.Recycle()
+			}
+		})
+		for {
+			select {
+			case messages <- newMessage(packer.AssembleHeader()):
+			case <-conn.done:
+				return
+			}
+		}
+	}()
+	for {
+		select {
+		case msg, ok := <-messages:
+			if !ok {
+				return nil
+			}
+			if err := f(msg); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return nil
+		case <-s.done:
+			return nil
+		}
+	}
+}
+
+// Dislabel take the connection off the label or pattern without asking the hooks,
+// the connection is not told about it
+func (s *Server) Dislabel(id uint64, label string) error {
+	conn, err := s.registry.conn(id)
+	if err != nil {
+		return err
+	}
+	if err = s.registry.dislabel(conn, label); err != nil {
+		return err
+	}
+	conn.mute(label, false)
+	return nil
+}
+
+// ready whether the server accepts connections
+func (s *Server) ready() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !s.closing() && len(s.listeners) > 0
+}
+
+// EnableAdmin serve the admin API at http://addr, the requests need the bearer token
+// unless it is empty, except for the health and readiness checks:
+//
+//	GET  /connections
+//	GET  /labels
+//	POST /kick?id=&reason=
+//	POST /dislabel?id=&label=
+//	POST /ban?id=&reason=
+//	POST /unban?identity=
+//	GET  /bans
+//	POST /publish?label=    the body is the data
+//	GET  /tail?label=       the messages as JSON lines until the request is canceled
+//	GET  /stats
+//	GET  /healthz
+//	GET  /readyz
+func (s *Server) EnableAdmin(addr, token string) {
+	mux := http.NewServeMux()
+	guard := func(method string, h func(w http.ResponseWriter, r *http.Request)) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != method {
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			if len(token) > 0 && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			h(w, r)
+		}
+	}
+	mux.HandleFunc("/connections", guard(http.MethodGet, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, s.Connections())
+	}))
+	mux.HandleFunc("/labels", guard(http.MethodGet, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, s.Labels())
+	}))
+	mux.HandleFunc("/kick", guard(http.MethodPost, func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseUint(r.FormValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid connection id", http.StatusBadRequest)
+			return
+		}
+		if err = s.Kick(id, r.FormValue("reason")); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	mux.HandleFunc("/dislabel", guard(http.MethodPost, func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseUint(r.FormValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid connection id", http.StatusBadRequest)
+			return
+		}
+		if err = s.Dislabel(id, r.FormValue("label")); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	mux.HandleFunc("/ban", guard(http.MethodPost, func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseUint(r.FormValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid connection id", http.StatusBadRequest)
+			return
+		}
+		identity, err := s.Ban(id, r.FormValue("reason"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, map[string]string{"identity": identity})
+	}))
+	mux.HandleFunc("/unban", guard(http.MethodPost, func(w http.ResponseWriter, r *http.Request) {
+		if err := s.Unban(r.FormValue("identity")); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	mux.HandleFunc("/bans", guard(http.MethodGet, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, s.Bans())
+	}))
+	mux.HandleFunc("/publish", guard(http.MethodPost, func(w http.ResponseWriter, r *http.Request) {
+		data, err := io.ReadAll(io.LimitReader(r.Body, int64(MaxPayloadSize)))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err = s.Publish(r.URL.Query().Get("label"), data); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	mux.HandleFunc("/tail", guard(http.MethodGet, func(w http.ResponseWriter, r *http.Request) {
+		flusher, _ := w.(http.Flusher)
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		encoder := json.NewEncoder(w)
+		encoder.SetEscapeHTML(false)
+		err := s.Tail(r.Context(), r.FormValue("label"), func(msg *Message) error {
+			if err := encoder.Encode(msg); err != nil {
+				return err
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+			return nil
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+	}))
+	mux.HandleFunc("/stats", guard(http.MethodGet, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, s.Stats())
+	}))
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if !s.ready() {
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok\n"))
+	})
+	server := &http.Server{Addr: addr, Handler: mux}
+	if !s.serve("admin", server) {
+		return
+	}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && !s.closing() {
+			logger.Error("admin server error: %v", err)
+		}
+	}()
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(v); err != nil {
+		logger.Error("failed to write the response: %v", err)
+	}
+}
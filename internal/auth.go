@@ -0,0 +1,278 @@
+package internal
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NanoRed/lim/internal/protocol"
+)
+
+// Identity the authenticated party behind a connection
+type Identity struct {
+	ID        string
+	Attrs     map[string]string
+	anonymous bool // the ID is the remote address of a client which claimed none
+}
+
+// Authenticator verify the credentials carried by the handshake
+type Authenticator interface {
+	Authenticate(hello *protocol.Hello, addr net.Addr) (*Identity, error)
+}
+
+// KeyAuthenticator resolve the challenge key of a claimed identity,
+// it enables the challenge-response handshake so that secrets never go through the wire
+type KeyAuthenticator interface {
+	Authenticator
+	Key(id string, addr net.Addr) (*Identity, []byte, error)
+}
+
+// SaltedKeyAuthenticator resolve the salt and the stored key of a claimed identity, the client
+// proves the salted key of its secret, which the stored key alone can not do (see protocol.SaltedKey).
+// An unknown identity gets a salt as well and an error, so that it looks the same to the client
+type SaltedKeyAuthenticator interface {
+	Authenticator
+	SaltedKey(id string, addr net.Addr) (identity *Identity, salt, storedKey []byte, err error)
+}
+
+var errBadCredentials = errors.New("bad credentials")
+
+// TokenCredentials the client credentials of a token issued by TokenAuthenticator
+func TokenCredentials(token string) (id string, secret []byte) {
+	if i := strings.LastIndexByte(token, '.'); i >= 0 {
+		id = token[:i]
+	}
+	return id, []byte(token)
+}
+
+// StaticSecretAuthenticator every client shares the same secret,
+// the identity is the claimed ID or the remote address
+type StaticSecretAuthenticator struct {
+	secret []byte
+}
+
+func NewStaticSecretAuthenticator(secret []byte) *StaticSecretAuthenticator {
+	return &StaticSecretAuthenticator{secret}
+}
+
+func (a *StaticSecretAuthenticator) Authenticate(hello *protocol.Hello, addr net.Addr) (*Identity, error) {
+	if subtle.ConstantTimeCompare(hello.Secret, a.secret) != 1 {
+		return nil, errBadCredentials
+	}
+	return a.identity(hello.ID, addr), nil
+}
+
+func (a *StaticSecretAuthenticator) Key(id string, addr net.Addr) (*Identity, []byte, error) {
+	return a.identity(id, addr), protocol.ChallengeKey(a.secret), nil
+}
+
+func (a *StaticSecretAuthenticator) identity(id string, addr net.Addr) *Identity {
+	if len(id) > 0 {
+		return &Identity{ID: id}
+	}
+	return anonymousIdentity(addr)
+}
+
+func anonymousIdentity(addr net.Addr) *Identity {
+	return &Identity{ID: addr.String(), anonymous: true}
+}
+
+// TokenAuthenticator the secret is a token issued by the same key,
+// token: base64(id).expiry.base64(hmac-sha256(key, base64(id).expiry)),
+// the claimed ID of a challenged client is the token without the signature
+// (see TokenCredentials)
+type TokenAuthenticator struct {
+	key []byte
+}
+
+func NewTokenAuthenticator(key []byte) *TokenAuthenticator {
+	return &TokenAuthenticator{key}
+}
+
+func (a *TokenAuthenticator) Issue(id string, ttl time.Duration) string {
+	claim := base64.RawURLEncoding.EncodeToString([]byte(id)) + "." +
+		strconv.FormatInt(time.Now().Add(ttl).Unix(), 10)
+	return claim + "." + base64.RawURLEncoding.EncodeToString(a.sign(claim))
+}
+
+func (a *TokenAuthenticator) Authenticate(hello *protocol.Hello, addr net.Addr) (*Identity, error) {
+	token := string(hello.Secret)
+	i := strings.LastIndexByte(token, '.')
+	if i < 0 {
+		return nil, errBadCredentials
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(token[i+1:])
+	if err != nil || !hmac.Equal(sig, a.sign(token[:i])) {
+		return nil, errBadCredentials
+	}
+	return a.parse(token[:i])
+}
+
+func (a *TokenAuthenticator) Key(id string, addr net.Addr) (*Identity, []byte, error) {
+	identity, err := a.parse(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	token := id + "." + base64.RawURLEncoding.EncodeToString(a.sign(id))
+	return identity, protocol.ChallengeKey([]byte(token)), nil
+}
+
+func (a *TokenAuthenticator) sign(claim string) []byte {
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write([]byte(claim))
+	return mac.Sum(nil)
+}
+
+func (a *TokenAuthenticator) parse(claim string) (*Identity, error) {
+	id, expiry, ok := strings.Cut(claim, ".")
+	if !ok {
+		return nil, errBadCredentials
+	}
+	uid, err := base64.RawURLEncoding.DecodeString(id)
+	if err != nil {
+		return nil, errBadCredentials
+	}
+	exp, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil {
+		return nil, errBadCredentials
+	}
+	if time.Now().Unix() > exp {
+		return nil, errors.New("token expired")
+	}
+	return &Identity{ID: string(uid)}, nil
+}
+
+type passwordEntry struct {
+	salt      []byte
+	storedKey []byte
+	attrs     map[string]string
+}
+
+const passwordScheme = "scrypt"
+
+// PasswordFileAuthenticator the claimed ID and secret are the user and password,
+// line: user:scrypt$hex(salt)$hex(stored key)[:key=value,key=value] (see HashPassword),
+// lines led by # are ignored
+type PasswordFileAuthenticator struct {
+	path   string
+	users  map[string]*passwordEntry
+	pepper []byte // makes up the salts of the unknown users
+	rwmu   sync.RWMutex
+}
+
+func NewPasswordFileAuthenticator(path string) (*PasswordFileAuthenticator, error) {
+	a := &PasswordFileAuthenticator{path: path, pepper: make([]byte, 32)}
+	if _, err := rand.Read(a.pepper); err != nil {
+		return nil, err
+	}
+	if err := a.Reload(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// HashPassword the password field of a line in the password file, with a random salt
+func HashPassword(password []byte) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key, err := protocol.SaltedKey(password, salt)
+	if err != nil {
+		return "", err
+	}
+	return passwordScheme + "$" + hex.EncodeToString(salt) + "$" + hex.EncodeToString(protocol.StoredKey(key)), nil
+}
+
+// Reload read the password file again, the old users are kept on error
+func (a *PasswordFileAuthenticator) Reload() error {
+	f, err := os.Open(a.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	users := make(map[string]*passwordEntry)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		fields := strings.SplitN(line, ":", 3)
+		if len(fields) < 2 {
+			return errors.New("malformed password file at line " + strconv.Itoa(n))
+		}
+		entry, err := parsePassword(fields[1])
+		if err != nil {
+			return fmt.Errorf("%v at line %d", err, n)
+		}
+		entry.attrs = make(map[string]string)
+		if len(fields) > 2 {
+			for _, kv := range strings.Split(fields[2], ",") {
+				if k, v, ok := strings.Cut(kv, "="); ok {
+					entry.attrs[strings.TrimSpace(k)] = strings.TrimSpace(v)
+				}
+			}
+		}
+		users[fields[0]] = entry
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+	a.rwmu.Lock()
+	a.users = users
+	a.rwmu.Unlock()
+	return nil
+}
+
+func parsePassword(field string) (*passwordEntry, error) {
+	parts := strings.Split(field, "$")
+	if len(parts) != 3 || parts[0] != passwordScheme {
+		return nil, errors.New("malformed password, hash it with limctl passwd")
+	}
+	salt, err := hex.DecodeString(parts[1])
+	if err != nil || len(salt) == 0 {
+		return nil, errors.New("malformed password salt")
+	}
+	storedKey, err := hex.DecodeString(parts[2])
+	if err != nil || len(storedKey) != sha256.Size {
+		return nil, errors.New("malformed password key")
+	}
+	return &passwordEntry{salt: salt, storedKey: storedKey}, nil
+}
+
+func (a *PasswordFileAuthenticator) Authenticate(hello *protocol.Hello, addr net.Addr) (*Identity, error) {
+	identity, salt, storedKey, err := a.SaltedKey(hello.ID, addr)
+	key, keyErr := protocol.SaltedKey(hello.Secret, salt) // even for an unknown user, which takes as long
+	if err != nil {
+		return nil, err
+	}
+	if keyErr != nil || subtle.ConstantTimeCompare(protocol.StoredKey(key), storedKey) != 1 {
+		return nil, errBadCredentials
+	}
+	return identity, nil
+}
+
+func (a *PasswordFileAuthenticator) SaltedKey(id string, addr net.Addr) (*Identity, []byte, []byte, error) {
+	a.rwmu.RLock()
+	entry, ok := a.users[id]
+	a.rwmu.RUnlock()
+	if !ok {
+		mac := hmac.New(sha256.New, a.pepper)
+		mac.Write([]byte(id))
+		return nil, mac.Sum(nil)[:16], nil, errBadCredentials
+	}
+	return &Identity{ID: id, Attrs: entry.attrs}, entry.salt, entry.storedKey, nil
+}
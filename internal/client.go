@@ -2,7 +2,12 @@ package internal
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"net"
 	"sync"
 	"sync/atomic"
@@ -13,6 +18,8 @@ import (
 	"github.com/NanoRed/lim/pkg/logger"
 )
 
+var ErrClientClosed = errors.New("client closed")
+
 const (
 	terminate int32 = iota
 	preparing
@@ -32,6 +39,18 @@ type Client struct {
 	labels     *sync.Map
 	context    []any
 	packer     *protocol.Packer
+	welcome    atomic.Pointer[protocol.Welcome] // replaced by every handshake
+	id         string
+	secret     []byte
+	salted     [2][]byte // the salt and the salted key of the secret, derived once
+	msgPrefix  string    // the message IDs are unique to the client
+	msgSeq     uint64
+	session    string // the token of the session to resume on reconnecting, guarded by mu
+	received   uint64 // the relayed frames received in the session, accessed atomically
+	running    bool   // connecting or connected until closed
+	done       chan struct{}
+	stopped    chan struct{} // closed once the connection is closed for good
+	mu         sync.Mutex
 }
 
 func NewClient(dialer func() (net.Conn, error)) *Client {
@@ -48,15 +67,106 @@ func NewClient(dialer func() (net.Conn, error)) *Client {
 		close:      make(chan struct{}, 1),
 		labels:     &sync.Map{},
 		context:    nil,
+		msgPrefix:  newMessagePrefix(),
+		done:       make(chan struct{}),
+		stopped:    make(chan struct{}),
 		packer: protocol.NewPacker(func() *protocol.Frame {
-			return sq.Pop().(*protocol.Frame)
+			frame, _ := sq.Pop().(*protocol.Frame)
+			if frame == nil { // closed, the other receivers are woken too
+				sq.Push(nil)
+			}
+			return frame
 		}),
 	}
 	sq2.Install(client.reqIn, client.reqOut)
 	return client
 }
 
+// SetCredentials the identity and secret verified by the server's authenticator,
+// it takes effect on the next handshake
+func (c *Client) SetCredentials(id string, secret []byte) {
+	c.id = id
+	c.secret = secret
+	c.salted = [2][]byte{}
+}
+
 func (c *Client) Connect() error {
+	return c.ConnectContext(context.Background())
+}
+
+// ConnectContext connect and keep reconnecting until the client is closed, which is done as
+// well once ctx is done. Like Connect it returns once connected, or ErrClientClosed if closed before
+func (c *Client) ConnectContext(ctx context.Context) error {
+	c.mu.Lock()
+	closed, running := c.closed(), c.running
+	c.running = true
+	c.mu.Unlock()
+	if closed {
+		return ErrClientClosed
+	}
+	if running {
+		return errors.New("the client has started connecting")
+	}
+	if ctx.Done() != nil {
+		go func() {
+			select {
+			case <-ctx.Done():
+				c.Close()
+			case <-c.stopped:
+			}
+		}()
+	}
+	if err := c.connect(); err != nil {
+		return err
+	}
+	if c.closed() {
+		return ErrClientClosed
+	}
+	return nil
+}
+
+// Close stop reconnecting, then close the connection with a close notice after the queued
+// requests are written and answered, so that the server does not keep its session. The requests
+// left fail with ErrClientClosed, and so does Receive once the data arrived before are received
+func (c *Client) Close() error {
+	c.mu.Lock()
+	closed, running := c.closed(), c.running
+	if !closed {
+		close(c.done)
+	}
+	c.mu.Unlock()
+	if closed {
+		<-c.stopped
+		return ErrClientClosed
+	}
+	if !running {
+		c.stop(0)
+	}
+	<-c.stopped
+	return nil
+}
+
+func (c *Client) closed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// stop end the client for good, the paused requests go on to fail
+func (c *Client) stop(times uint32) {
+	c.mu.Lock()
+	if atomic.LoadUint32(&c.pauseTimes) != times {
+		c.pauseValve.Done()
+	}
+	c.mu.Unlock()
+	c.arrive.Push(nil)
+	close(c.stopped)
+}
+
+func (c *Client) connect() error {
 	if !atomic.CompareAndSwapInt32(&c.state, terminate, preparing) {
 		return errors.New("the client has started connecting")
 	}
@@ -83,29 +193,44 @@ func (c *Client) Connect() error {
 		defer func() {
 			c.context = []any{times, block, delay}
 			atomic.StoreInt32(&c.state, terminate)
-			logger.Warn("reconnect in %d seconds...", delay)
-			time.Sleep(delay * time.Second)
-			if err := c.Connect(); err != nil {
-				logger.Error("reconnect failed: %v", err)
+			if !c.closed() {
+				logger.Warn("reconnect in %d seconds...", delay)
+				select {
+				case <-time.After(delay * time.Second):
+					if err := c.connect(); err != nil {
+						logger.Error("reconnect failed: %v", err)
+					}
+					return
+				case <-c.done:
+				}
+			}
+			select {
+			case <-block: // never connected, Connect returns
+			default:
 			}
+			c.stop(times)
 		}()
-		var err error
-		conn := &conn{}
-		conn.Conn, err = c.dialer()
+		nc, err := c.dialer()
 		if err != nil {
 			logger.Error("failed to dial to server: %v", err)
 			return
 		}
+		conn := newConn(nc)
 		defer conn.Close()
+		if c.closed() {
+			return
+		}
 		processor := protocol.NewFrameProcessor(conn)
 		if err = c.handshake(processor); err != nil {
 			logger.Error("handshake failed: %v", err)
 			return
 		}
 		delay = 0
-		if err = c.relabel(processor); err != nil {
-			logger.Error("failed to relabel: %v", err)
-			return
+		if !c.welcomed().Resumed { // a resumed session keeps its labels
+			if err = c.relabel(processor); err != nil {
+				logger.Error("failed to relabel: %v", err)
+				return
+			}
 		}
 		if newTimes := atomic.LoadUint32(&c.pauseTimes); times != newTimes {
 			c.pauseValve.Done() // restart the queues
@@ -113,9 +238,11 @@ func (c *Client) Connect() error {
 		}
 		<-block
 		respSQ := container.NewSyncQueue()
-		go c.sendLoop(processor.FrameEncoder, respSQ)
+		received := make(chan struct{})
+		go c.sendLoop(processor.FrameEncoder, respSQ, received)
 		atomic.StoreInt32(&c.state, working)
 		c.recvLoop(processor.FrameDecoder, respSQ)
+		close(received)
 	}()
 	return nil
 }
@@ -133,14 +260,28 @@ func (c *Client) recvLoop(decoder *protocol.FrameDecoder, respSQ *container.Sync
 			case respSQ.Pop().(chan any) <- frame:
 			default:
 			}
-		case protocol.ActMulticast:
+		case protocol.ActMulticast, protocol.ActUnicast:
+			atomic.AddUint64(&c.received, 1)
+			welcome := c.welcomed()
+			if err := protocol.Decompress(welcome.Compression, frame, int(welcome.MaxPayload)); err != nil {
+				logger.Error("failed to decompress frame: %v", err)
+				frame.Recycle()
+				continue
+			}
 			c.arrive.Push(frame)
+		case protocol.ActClose:
+			logger.Warn("connection closed by the server: %s", frame.Payload)
+			c.mu.Lock()
+			c.session = ""
+			c.mu.Unlock()
+			return
 		}
 	}
 }
 
-func (c *Client) sendLoop(encoder *protocol.FrameEncoder, respSQ *container.SyncQueue) {
+func (c *Client) sendLoop(encoder *protocol.FrameEncoder, respSQ *container.SyncQueue, received <-chan struct{}) {
 	times := c.pauseTimes
+	heartbeat := c.welcomed().Heartbeat
 	heartbeatFrame := protocol.NewFrame()
 	heartbeatFrame.Act = protocol.ActResponse
 	defer encoder.Close()
@@ -149,45 +290,92 @@ func (c *Client) sendLoop(encoder *protocol.FrameEncoder, respSQ *container.Sync
 		case <-c.close:
 			logger.Error("sendLoop closed")
 			return
+		case <-c.done:
+			c.goodbye(encoder, respSQ, received)
+			return
 		case v := <-c.reqOut:
-			atomic.AddUint32(&c.reqNum, ^uint32(0))
-			switch val := v.(type) {
-			case *protocol.Frame:
-				if err := encoder.Encode(val); err != nil {
-					c.pause(times)
-					val.Recycle()
-					logger.Error("failed to write data: %v", err)
-					<-c.close
-					return
-				}
-				val.Recycle()
-			case chan any:
-				reqFrame := (<-val).(*protocol.Frame)
-				if err := encoder.Encode(reqFrame); err != nil {
-					c.pause(times)
-					select {
-					case val <- err:
-					default:
-					}
-					reqFrame.Recycle()
-					logger.Error("failed to write data: %v", err)
-					<-c.close
-					return
-				}
-				respSQ.Push(val)
-				reqFrame.Recycle()
+			if err := c.send(encoder, respSQ, v); err != nil {
+				c.pause(times)
+				logger.Error("failed to write data: %v", err)
+				c.halt()
+				return
 			}
-		case <-time.After(HeartbeatInterval):
+		case <-time.After(heartbeat):
 			if err := encoder.Encode(heartbeatFrame); err != nil {
 				c.pause(times)
 				logger.Error("failed to write data: %v", err)
-				<-c.close
+				c.halt()
 				return
 			}
 		}
 	}
 }
 
+// send write the queued request, the carrier of one waiting for the response is queued
+// for the response once written
+func (c *Client) send(encoder *protocol.FrameEncoder, respSQ *container.SyncQueue, v any) (err error) {
+	atomic.AddUint32(&c.reqNum, ^uint32(0))
+	switch val := v.(type) {
+	case *protocol.Frame:
+		err = encoder.Encode(val)
+		val.Recycle()
+	case chan any:
+		reqFrame := (<-val).(*protocol.Frame)
+		if err = encoder.Encode(reqFrame); err != nil {
+			select {
+			case val <- err:
+			default:
+			}
+		} else {
+			respSQ.Push(val)
+		}
+		reqFrame.Recycle()
+	}
+	return
+}
+
+// halt wait for the pause of a failed writer, which is skipped once closed
+func (c *Client) halt() {
+	select {
+	case <-c.close:
+	case <-c.done:
+	}
+}
+
+// goodbye write the queued requests and the close notice, the server answers the requests
+// and closes the connection without keeping its session
+func (c *Client) goodbye(encoder *protocol.FrameEncoder, respSQ *container.SyncQueue, received <-chan struct{}) {
+	timeout := time.After(ResponseTimeout)
+	for atomic.LoadUint32(&c.reqNum) > 0 {
+		select {
+		case v := <-c.reqOut:
+			if err := c.send(encoder, respSQ, v); err != nil {
+				logger.Error("failed to write data: %v", err)
+				return
+			}
+		case <-received:
+			return
+		case <-timeout:
+			return
+		}
+	}
+	if c.welcomed().Version < protocol.V2 {
+		return
+	}
+	notice := protocol.NewFrame()
+	notice.Act = protocol.ActClose
+	notice.Payload = []byte("client closed")
+	defer notice.Recycle()
+	if err := encoder.Encode(notice); err != nil {
+		logger.Error("failed to write data: %v", err)
+		return
+	}
+	select {
+	case <-received:
+	case <-timeout:
+	}
+}
+
 func (c *Client) requestUnfriendly(processor *protocol.FrameProcessor, frame *protocol.Frame) (err error) {
 	if err = processor.Encode(frame); err != nil {
 		return
@@ -207,10 +395,11 @@ func (c *Client) requestUnfriendly(processor *protocol.FrameProcessor, frame *pr
 			if _, err = processor.Decode(frame); err != nil {
 				return
 			}
-			if frame.Act == protocol.ActResponse {
-				if len(frame.Payload) > 0 {
-					err = errors.New(string(frame.Payload))
-				}
+			switch frame.Act {
+			case protocol.ActResponse:
+				err = protocol.ResponseError(frame.Payload)
+				return
+			case protocol.ActHandshake: // challenge
 				return
 			}
 		}
@@ -218,63 +407,158 @@ func (c *Client) requestUnfriendly(processor *protocol.FrameProcessor, frame *pr
 }
 
 func (c *Client) handshake(processor *protocol.FrameProcessor) (err error) {
+	c.mu.Lock()
+	session := c.session
+	c.mu.Unlock()
 	frame := protocol.NewFrame()
 	frame.Act = protocol.ActHandshake
-	frame.Payload = []byte{'s', 'a', 'm', 'p', 'l', 'e', '_', 's', 'e', 'c', 'r', 'e', 't'}
-	err = c.requestUnfriendly(processor, frame)
-	frame.Recycle()
+	frame.Payload = (&protocol.Hello{
+		Versions:     protocol.Versions,
+		Compressions: protocol.Compressions,
+		MaxPayload:   MaxPayloadSize,
+		Heartbeat:    HeartbeatInterval,
+		ID:           c.id,
+		Challenge:    true,
+		Session:      session,
+		Received:     atomic.LoadUint64(&c.received),
+	}).Marshal()
+	defer frame.Recycle()
+	if err = c.requestUnfriendly(processor, frame); err != nil {
+		return
+	}
+	if frame.Act == protocol.ActHandshake {
+		if err = c.answer(processor, frame); err != nil {
+			return
+		}
+	}
+	welcome, err := protocol.UnmarshalWelcome(frame.Payload)
+	if err != nil {
+		return
+	}
+	if welcome.Heartbeat == 0 {
+		welcome.Heartbeat = HeartbeatInterval
+	}
+	if welcome.MaxPayload == 0 {
+		welcome.MaxPayload = uint32(welcome.Version.MaxPayload())
+	}
+	if !welcome.Resumed {
+		atomic.StoreUint64(&c.received, 0)
+	}
+	c.mu.Lock()
+	c.session = welcome.Session
+	c.mu.Unlock()
+	c.welcome.Store(welcome)
+	processor.SetVersion(welcome.Version)
+	processor.SetMaxPayload(int(welcome.MaxPayload))
+	processor.SetCompression(welcome.Compression, CompressThreshold)
+	c.packer.SetMaxPayload(int(welcome.MaxPayload))
+	return
+}
+
+// answer prove the secret for the challenge in the frame
+func (c *Client) answer(processor *protocol.FrameProcessor, frame *protocol.Frame) (err error) {
+	challenge, err := protocol.UnmarshalChallenge(frame.Payload)
+	if err != nil {
+		return
+	}
+	proof := &protocol.Proof{}
+	if len(challenge.Salt) > 0 && len(challenge.Nonce) > 0 {
+		if !bytes.Equal(c.salted[0], challenge.Salt) {
+			key, err := protocol.SaltedKey(c.secret, challenge.Salt)
+			if err != nil {
+				return err
+			}
+			c.salted = [2][]byte{challenge.Salt, key}
+		}
+		proof.Time = time.Now()
+		proof.SignSalted(c.salted[1], challenge.Nonce, c.id)
+	} else if len(challenge.Nonce) > 0 {
+		proof.Time = time.Now()
+		proof.Sign(protocol.ChallengeKey(c.secret), challenge.Nonce, c.id)
+	} else {
+		proof.Secret = c.secret
+	}
+	frame.Act = protocol.ActHandshake
+	frame.Label = ""
+	frame.Payload = proof.Marshal()
+	if err = c.requestUnfriendly(processor, frame); err != nil {
+		return
+	}
+	if frame.Act != protocol.ActResponse {
+		err = errors.New("unexpected challenge")
+	}
 	return
 }
 
 func (c *Client) relabel(processor *protocol.FrameProcessor) (err error) {
-	buf := &bytes.Buffer{}
-	labels := make([]string, 0, 1)
-	c.labels.Range(func(key, value any) bool {
-		label := key.(string)
-		if bl := buf.Len(); bl+len(label) > 255 {
+	for _, quiet := range []bool{false, true} {
+		buf := &bytes.Buffer{}
+		labels := make([]string, 0, 1)
+		c.labels.Range(func(key, value any) bool {
+			label := key.(string)
+			if value.(bool) != quiet {
+				return true
+			}
+			if bl := buf.Len(); bl+len(label) > 255 {
+				labels = append(labels, buf.String()[:bl-1])
+				buf.Reset()
+			}
+			buf.WriteString(label)
+			buf.WriteByte('|')
+			return true
+		})
+		if bl := buf.Len(); bl > 0 {
 			labels = append(labels, buf.String()[:bl-1])
-			buf.Reset()
-		}
-		buf.WriteString(label)
-		buf.WriteByte('|')
-		return true
-	})
-	if bl := buf.Len(); bl > 0 {
-		labels = append(labels, buf.String()[:bl-1])
-		frame := protocol.NewFrame()
-		frame.Act = protocol.ActLabel
-		frame.Payload = []byte{'*'}
-		for _, frame.Label = range labels {
-			err = c.requestUnfriendly(processor, frame)
+			frame := protocol.NewFrame()
+			frame.Act = protocol.ActLabel
+			frame.Payload = []byte{'*'}
+			if quiet {
+				frame.Flags = protocol.FlagNoEcho
+			}
+			for _, frame.Label = range labels {
+				err = c.requestUnfriendly(processor, frame)
+				if err != nil {
+					break
+				}
+			}
+			frame.Recycle()
 			if err != nil {
-				break
+				return
 			}
 		}
-		frame.Recycle()
 	}
 	return
 }
 
 func (c *Client) request(frame *protocol.Frame, waitResp bool) (err error) {
 	c.pauseValve.Wait()
+	if c.closed() {
+		frame.Recycle()
+		return ErrClientClosed
+	}
 	if waitResp {
 		times := c.pauseTimes
 		carrier := make(chan any)
 		c.reqIn <- carrier
 		atomic.AddUint32(&c.reqNum, 1)
-		carrier <- frame
+		select {
+		case carrier <- frame:
+		case <-c.stopped:
+			frame.Recycle()
+			return ErrClientClosed
+		}
 		select {
 		case v := <-carrier:
 			switch val := v.(type) {
 			case *protocol.Frame:
-				if len(val.Payload) > 0 {
-					err = errors.New(string(val.Payload))
-				}
+				err = protocol.ResponseError(val.Payload)
 				val.Recycle()
 			case error:
 				err = val
 			}
 			close(carrier)
+		case <-c.stopped:
+			err = ErrClientClosed
 		case <-time.After(ResponseTimeout):
 			c.pause(times)
 			err = errors.New("request timed out")
@@ -286,9 +570,15 @@ func (c *Client) request(frame *protocol.Frame, waitResp bool) (err error) {
 	return
 }
 
+// pause block the requests until reconnecting, the valve stays open once closed
 func (c *Client) pause(times uint32) {
-	if atomic.CompareAndSwapUint32(&c.pauseTimes, times, times+1) {
+	c.mu.Lock()
+	paused := !c.closed() && atomic.CompareAndSwapUint32(&c.pauseTimes, times, times+1)
+	if paused {
 		c.pauseValve.Add(1)
+	}
+	c.mu.Unlock()
+	if paused {
 		c.close <- struct{}{}
 	}
 }
@@ -297,7 +587,7 @@ func (c *Client) Label(label string) (err error) {
 	if len(label) == 0 {
 		return errors.New("invalid label")
 	}
-	c.labels.Store(label, nil)
+	c.labels.Store(label, false)
 	frame := protocol.NewFrame()
 	frame.Act = protocol.ActLabel
 	frame.Label = label
@@ -306,6 +596,39 @@ func (c *Client) Label(label string) (err error) {
 	return
 }
 
+// LabelNoEcho label the connection without hearing its own multicasts to the label
+func (c *Client) LabelNoEcho(label string) (err error) {
+	if len(label) == 0 {
+		return errors.New("invalid label")
+	}
+	if c.welcomed().Version < protocol.V2 {
+		return errors.New("echo suppression requires protocol v2")
+	}
+	c.labels.Store(label, true)
+	frame := protocol.NewFrame()
+	frame.Act = protocol.ActLabel
+	frame.Flags = protocol.FlagNoEcho
+	frame.Label = label
+	frame.Payload = []byte{'+'}
+	err = c.request(frame, true)
+	return
+}
+
+// LabelSince label the connection and ask for the messages of the label with a
+// sequence number after seq that the server still keeps, they arrive before the live ones
+func (c *Client) LabelSince(label string, seq uint64) (err error) {
+	if len(label) == 0 {
+		return errors.New("invalid label")
+	}
+	c.labels.Store(label, false)
+	frame := protocol.NewFrame()
+	frame.Act = protocol.ActLabel
+	frame.Label = label
+	frame.Payload = binary.AppendUvarint([]byte{'+'}, seq)
+	err = c.request(frame, true)
+	return
+}
+
 func (c *Client) Dislabel(label string) (err error) {
 	if len(label) == 0 {
 		return errors.New("invalid label")
@@ -323,12 +646,171 @@ func (c *Client) Multicast(label string, data any) (err error) {
 	if len(label) == 0 {
 		return errors.New("invalid label")
 	}
-	for frame := range c.packer.Pack(label, data) {
-		c.request(frame, false)
+	return c.requestAll(c.packer.Pack(label, data), nil, false)
+}
+
+// MulticastNoEcho multicast the data without delivering it back to this connection
+func (c *Client) MulticastNoEcho(label string, data any) (err error) {
+	if len(label) == 0 {
+		return errors.New("invalid label")
+	}
+	if c.welcomed().Version < protocol.V2 {
+		return errors.New("echo suppression requires protocol v2")
+	}
+	return c.requestAll(c.packer.Pack(label, data), func(frame *protocol.Frame) {
+		frame.Flags |= protocol.FlagNoEcho
+	}, false)
+}
+
+// MulticastAck multicast the data and wait for the server to confirm it is fanned out
+// (and appended to the journal). An unanswered one is sent again after reconnecting, up to
+// PublishRetries times, so that a receiver may get it twice and should dedupe by Message.ID.
+// A refusal of the server is returned as a *protocol.Error without retrying
+func (c *Client) MulticastAck(label string, data []byte) (id string, err error) {
+	if len(label) == 0 {
+		return "", errors.New("invalid label")
+	}
+	if c.welcomed().Version < protocol.V2 {
+		return "", errors.New("acknowledged multicast requires protocol v2")
+	}
+	id = fmt.Sprintf("%s-%d", c.msgPrefix, atomic.AddUint64(&c.msgSeq, 1))
+	for retries := 0; ; retries++ {
+		if err = c.publish(label, data, id); err == nil {
+			return
+		}
+		var refused *protocol.Error
+		if errors.As(err, &refused) || errors.Is(err, ErrClientClosed) || retries >= PublishRetries {
+			return
+		}
+		logger.Warn("multicast %s unacknowledged, send it again: %v", id, err)
+	}
+}
+
+// publish request every piece of the data with an acknowledgement, the request waits
+// for the reconnection of a paused client
+func (c *Client) publish(label string, data []byte, id string) (err error) {
+	return c.requestAll(c.packer.Pack(label, data), func(frame *protocol.Frame) {
+		frame.Flags |= protocol.FlagAck
+		frame.SetExtension(protocol.ExtMessageID, []byte(id))
+	}, true)
+}
+
+// requestAll request the packed frames one by one, after an error the rest are recycled
+func (c *Client) requestAll(frames <-chan *protocol.Frame, prepare func(frame *protocol.Frame), waitResp bool) (err error) {
+	for frame := range frames {
+		if err != nil {
+			frame.Recycle()
+			continue
+		}
+		if prepare != nil {
+			prepare(frame)
+		}
+		err = c.request(frame, waitResp)
 	}
 	return
 }
 
-func (c *Client) Receive() (label string, data [][]byte) {
-	return c.packer.Assemble()
+func newMessagePrefix() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		binary.BigEndian.PutUint64(b, uint64(time.Now().UnixNano()))
+	}
+	return hex.EncodeToString(b)
+}
+
+// Send deliver the data to a single connection (ConnTarget) or every connection
+// of a user (UserTarget), the receiver sees the sender's connection as the label.
+// It waits for the server, which answers a target it does not know with a *protocol.Error
+func (c *Client) Send(target string, data any) (err error) {
+	if len(target) == 0 {
+		return errors.New("invalid target")
+	}
+	if c.welcomed().Version < protocol.V2 {
+		return errors.New("unicast requires protocol v2")
+	}
+	return c.requestAll(c.packer.Pack(target, data), func(frame *protocol.Frame) {
+		frame.Act = protocol.ActUnicast
+		frame.Flags |= protocol.FlagAck
+	}, true)
+}
+
+// Ack acknowledge the messages of the label up to seq, a server with a journal
+// delivers the ones after it when the same identity labels again
+func (c *Client) Ack(label string, seq uint64) (err error) {
+	if len(label) == 0 {
+		return errors.New("invalid label")
+	}
+	if c.welcomed().Version < protocol.V2 {
+		return errors.New("ack requires protocol v2")
+	}
+	frame := protocol.NewFrame()
+	frame.Act = protocol.ActAck
+	frame.Label = label
+	frame.Payload = binary.AppendUvarint(nil, seq)
+	return c.request(frame, false)
+}
+
+// ConnID the ID of the current connection assigned by the server,
+// it changes on every reconnection
+func (c *Client) ConnID() uint64 {
+	return c.welcomed().ConnID
+}
+
+// welcomed the welcome of the current connection, a zero one before the first handshake
+func (c *Client) welcomed() *protocol.Welcome {
+	if welcome := c.welcome.Load(); welcome != nil {
+		return welcome
+	}
+	return &protocol.Welcome{}
+}
+
+// Receive wait for the next data, ErrClientClosed once the client is closed
+// and the data arrived before are received
+func (c *Client) Receive() (label string, data [][]byte, err error) {
+	msg, err := c.ReceiveMessage()
+	if err != nil {
+		return
+	}
+	return msg.Label, msg.Data, nil
+}
+
+// Message the data delivered with the metadata stamped by the server,
+// the metadata is zero on a legacy server
+type Message struct {
+	ID         string    `json:"id"`    // given by the publisher of an acknowledged multicast
+	Label      string    `json:"label"` // the sender's connection target for a unicast
+	Data       [][]byte  `json:"data"`
+	Unicast    bool      `json:"unicast"`
+	Seq        uint64    `json:"seq"` // per-label sequence number of the frame completing the data
+	Time       time.Time `json:"time"`
+	SenderConn uint64    `json:"sender_conn"`
+	SenderUser string    `json:"sender_user"`
+}
+
+func (c *Client) ReceiveMessage() (*Message, error) {
+	header, data := c.packer.AssembleHeader()
+	if data == nil {
+		return nil, ErrClientClosed
+	}
+	return newMessage(header, data), nil
+}
+
+func newMessage(header protocol.Frame, data [][]byte) *Message {
+	msg := &Message{
+		Label:   header.Label,
+		Data:    data,
+		Unicast: header.Act == protocol.ActUnicast,
+	}
+	msg.Seq, _ = header.Uvarint(protocol.ExtSequence)
+	if ms, ok := header.Uvarint(protocol.ExtTimestamp); ok {
+		msg.Time = time.UnixMilli(int64(ms))
+	}
+	msg.SenderConn, _ = header.Uvarint(protocol.ExtSenderConn)
+	if id, ok := header.Extension(protocol.ExtMessageID); ok {
+		msg.ID = string(id)
+	}
+	if user, ok := header.Extension(protocol.ExtSenderUser); ok {
+		msg.SenderUser = string(user)
+	}
+	return msg
 }
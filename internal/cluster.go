@@ -0,0 +1,310 @@
+package internal
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/NanoRed/lim/internal/protocol"
+	"github.com/NanoRed/lim/pkg/logger"
+)
+
+// cluster the links to the peer nodes, a node tells its peers the labels it has
+// members for and forwards the multicasts only to the peers interested in them.
+// The frames on a link are v2, a forwarded frame keeps the time and sender stamped by its
+// origin node but takes the label sequence of the receiving node, it is recorded in the
+// history and journal there and delivered to the local members only (no re-forwarding)
+type cluster struct {
+	server  *Server
+	name    string
+	key     []byte // proving the cluster secret
+	nonces  *nonceCache
+	ln      net.Listener
+	peers   *sync.Map // name -> *peer
+	pending map[string]struct{}
+	signal  chan struct{}
+	done    chan struct{}
+	mu      sync.Mutex
+}
+
+type peer struct {
+	name      string
+	conn      *conn
+	processor *protocol.FrameProcessor
+	labels    *sync.Map // the labels the peer has members for
+	patterns  *sync.Map // the patterns the peer has members for
+	wmu       sync.Mutex
+}
+
+func newCluster(server *Server, name string, ln net.Listener, secret []byte) *cluster {
+	return &cluster{
+		server:  server,
+		name:    name,
+		key:     protocol.ChallengeKey(secret),
+		nonces:  newNonceCache(),
+		ln:      ln,
+		peers:   &sync.Map{},
+		pending: make(map[string]struct{}),
+		signal:  make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+}
+
+func (c *cluster) accept() {
+	for {
+		nc, err := c.ln.Accept()
+		if err != nil {
+			select {
+			case <-c.done:
+				return
+			default:
+			}
+			logger.Error("cluster accept error: %v", err)
+			continue
+		}
+		go c.serve(nc, false)
+	}
+}
+
+// dial keep a link to the peer at addr, a link already set up by the peer is reused
+func (c *cluster) dial(addr string) {
+	var name string
+	for {
+		if _, ok := c.peers.Load(name); !ok {
+			if nc, err := net.DialTimeout("tcp", addr, ConnWriteTimeout); err != nil {
+				logger.Warn("failed to dial the peer %s: %v", addr, err)
+			} else {
+				name = c.serve(nc, true)
+			}
+		}
+		select {
+		case <-c.done:
+			return
+		case <-time.After(time.Second + time.Duration(rand.Int63n(int64(time.Second)))):
+		}
+	}
+}
+
+// serve set up the link and block until it breaks, it returns the peer name
+func (c *cluster) serve(nc net.Conn, dialer bool) (name string) {
+	p := &peer{conn: newConn(nc), labels: &sync.Map{}, patterns: &sync.Map{}}
+	p.processor = protocol.NewFrameProcessor(p.conn)
+	p.processor.SetVersion(protocol.V2)
+	p.processor.SetMaxPayload(int(MaxPayloadSize))
+	defer p.conn.Close()
+	var err error
+	if p.name, err = c.handshake(p, dialer); err != nil {
+		logger.Error("cluster handshake with %s failed: %v", nc.RemoteAddr(), err)
+		return
+	}
+	name = p.name
+	if _, loaded := c.peers.LoadOrStore(p.name, p); loaded {
+		return // there has been a link with the peer
+	}
+	defer c.peers.CompareAndDelete(p.name, p)
+	logger.Info("cluster peer joined: %s %s", p.name, nc.RemoteAddr())
+	defer logger.Warn("cluster peer left: %s", p.name)
+	p.conn.serve(SendQueueSize, QueueDisconnect) // a lagging link is reset, the interests are sent again on the next one
+
+	for _, label := range c.server.registry.labels() {
+		p.interest(label, true)
+	}
+	go func() {
+		heartbeat := &protocol.Frame{Act: protocol.ActResponse}
+		for {
+			select {
+			case <-c.done:
+				nc.Close()
+				return
+			case <-time.After(HeartbeatInterval):
+				if err := p.send(heartbeat); err != nil {
+					return
+				}
+			}
+		}
+	}()
+	frame := &protocol.Frame{}
+	for {
+		if err = p.processor.SetDecodeTimeout(ConnReadDuration); err != nil {
+			return
+		}
+		if _, err = p.processor.Decode(frame); err != nil {
+			logger.Error("failed to read next frame from peer %s: %v", p.name, err)
+			return
+		}
+		switch frame.Act {
+		case protocol.ActLabel:
+			interests := p.labels
+			if isPattern(frame.Label) {
+				interests = p.patterns
+			}
+			if len(frame.Payload) > 0 && frame.Payload[0] == '+' {
+				interests.Store(frame.Label, nil)
+			} else {
+				interests.Delete(frame.Label)
+			}
+		case protocol.ActMulticast:
+			c.server.relay(frame)
+		}
+	}
+}
+
+// handshake exchange the node names with a nonce each, then both nodes prove the cluster
+// secret with an HMAC of the nonce of the other one, the secret never goes through the link
+func (c *cluster) handshake(p *peer, dialer bool) (name string, err error) {
+	nonce, err := c.nonces.issue()
+	if err != nil {
+		return
+	}
+	hello := &protocol.Frame{Act: protocol.ActHandshake, Label: c.name, Payload: (&protocol.Challenge{Nonce: nonce}).Marshal()}
+	if dialer {
+		if err = p.send(hello); err != nil {
+			return
+		}
+	}
+	frame, err := p.receive()
+	if err != nil {
+		return
+	}
+	challenge, err := protocol.UnmarshalChallenge(frame.Payload)
+	if err != nil {
+		return
+	}
+	if name = frame.Label; len(name) == 0 || name == c.name || len(challenge.Nonce) == 0 {
+		return "", errors.New("illegal peer")
+	}
+	if !dialer {
+		if err = p.send(hello); err != nil {
+			return
+		}
+	}
+	proof := &protocol.Proof{Time: time.Now()}
+	proof.Sign(c.key, challenge.Nonce, c.name)
+	if err = p.send(&protocol.Frame{Act: protocol.ActHandshake, Payload: proof.Marshal()}); err != nil {
+		return
+	}
+	if frame, err = p.receive(); err != nil {
+		return
+	}
+	if proof, err = protocol.UnmarshalProof(frame.Payload); err != nil {
+		return
+	}
+	if !c.nonces.consume(nonce) {
+		return "", errors.New("nonce expired or reused")
+	}
+	if skew := time.Since(proof.Time); skew > ChallengeSkew || skew < -ChallengeSkew {
+		return "", errors.New("proof out of the clock skew window")
+	}
+	if !proof.Verify(c.key, nonce, name) {
+		return "", errBadCredentials
+	}
+	return
+}
+
+// receive read the next handshake frame of the peer
+func (p *peer) receive() (*protocol.Frame, error) {
+	frame := &protocol.Frame{}
+	if err := p.processor.SetDecodeTimeout(ConnReadDuration); err != nil {
+		return nil, err
+	}
+	if _, err := p.processor.Decode(frame); err != nil {
+		return nil, err
+	}
+	if frame.Act != protocol.ActHandshake {
+		return nil, errors.New("illegal peer")
+	}
+	return frame, nil
+}
+
+func (p *peer) send(frame *protocol.Frame) error {
+	p.wmu.Lock()
+	defer p.wmu.Unlock()
+	err := p.processor.Encode(frame)
+	if err != nil {
+		p.conn.Close()
+	}
+	return err
+}
+
+func (p *peer) interested(label string) bool {
+	if _, ok := p.labels.Load(label); ok {
+		return true
+	}
+	interested := false
+	p.patterns.Range(func(key, value any) bool {
+		interested = matchPattern(key.(string), label)
+		return !interested
+	})
+	return interested
+}
+
+func (p *peer) interest(label string, present bool) error {
+	frame := &protocol.Frame{Act: protocol.ActLabel, Label: label, Payload: []byte{'-'}}
+	if present {
+		frame.Payload[0] = '+'
+	}
+	return p.send(frame)
+}
+
+// changed queue the label to tell the peers whether there are members for it
+func (c *cluster) changed(label string) {
+	c.mu.Lock()
+	c.pending[label] = struct{}{}
+	c.mu.Unlock()
+	select {
+	case c.signal <- struct{}{}:
+	default:
+	}
+}
+
+func (c *cluster) announce() {
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-c.signal:
+		}
+		c.mu.Lock()
+		pending := c.pending
+		c.pending = make(map[string]struct{})
+		c.mu.Unlock()
+		for label := range pending {
+			present := c.server.registry.has(label)
+			c.peers.Range(func(key, value any) bool {
+				value.(*peer).interest(label, present)
+				return true
+			})
+		}
+	}
+}
+
+// forward send the frame to the peers with members for the label
+func (c *cluster) forward(label string, fanout *fanout) {
+	var e *encoding
+	c.peers.Range(func(key, value any) bool {
+		p := value.(*peer)
+		if !p.interested(label) {
+			return true
+		}
+		if e == nil {
+			if e = fanout.variant(variant{version: protocol.V2}); e.err != nil {
+				logger.Error("failed to encode frame for peers: %v", e.err)
+				return false
+			}
+		}
+		p.conn.enqueue(e.data[0])
+		return true
+	})
+}
+
+func (c *cluster) close() error {
+	close(c.done)
+	err := c.ln.Close()
+	c.peers.Range(func(key, value any) bool {
+		value.(*peer).conn.Close()
+		return true
+	})
+	return err
+}
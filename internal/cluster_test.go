@@ -0,0 +1,251 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+var clusterSecret = []byte("cluster_secret")
+
+type node struct {
+	server  *Server
+	addr    string // for the clients
+	cluster string // for the peers
+}
+
+func startNode(t *testing.T, name, clusterAddr string, peers ...*node) *node {
+	t.Helper()
+	n := &node{server: NewServer()}
+	n.server.EnableHistory(16, 0)
+	var addrs []string
+	for _, peer := range peers {
+		addrs = append(addrs, peer.cluster)
+	}
+	if err := n.server.EnableCluster(name, clusterAddr, addrs, clusterSecret); err != nil {
+		t.Fatal(err)
+	}
+	n.cluster = n.server.cluster.ln.Addr().String()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.addr = ln.Addr().String()
+	ln.Close()
+	go n.server.ListenAndServe(n.addr)
+	return n
+}
+
+func (n *node) stop() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	n.server.Shutdown(ctx)
+}
+
+func (n *node) client(t *testing.T) *Client {
+	t.Helper()
+	client := NewClient(func() (net.Conn, error) { return net.Dial("tcp", n.addr) })
+	var err error
+	for i := 0; i < 50; i++ { // the listener may not be up yet
+		if err = client.Connect(); err == nil {
+			t.Cleanup(func() { client.Close() })
+			return client
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal(err)
+	return nil
+}
+
+// awaitInterest wait until the node knows its peer has members for the label
+func (n *node) awaitInterest(t *testing.T, name, label string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if value, ok := n.server.cluster.peers.Load(name); ok && value.(*peer).interested(label) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("no interest of %s in %s", name, label)
+}
+
+func receive(t *testing.T, client *Client) *Message {
+	t.Helper()
+	received := make(chan *Message, 1)
+	go func() {
+		msg, _ := client.ReceiveMessage()
+		received <- msg
+	}()
+	select {
+	case msg := <-received:
+		if msg == nil {
+			t.Fatal("the client is closed")
+		}
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out receiving")
+		return nil
+	}
+}
+
+func expect(t *testing.T, client *Client, label string, data []byte) *Message {
+	t.Helper()
+	msg := receive(t, client)
+	if msg.Label != label || len(msg.Data) != 1 || !bytes.Equal(msg.Data[0], data) {
+		t.Fatalf("received %q %q, expected %q %q", msg.Label, msg.Data, label, data)
+	}
+	return msg
+}
+
+func TestClusterMulticast(t *testing.T) {
+	a := startNode(t, "a", "127.0.0.1:0")
+	defer a.stop()
+	b := startNode(t, "b", "127.0.0.1:0", a)
+	defer b.stop()
+	c := startNode(t, "c", "127.0.0.1:0", a, b)
+	defer c.stop()
+
+	publisher, member := a.client(t), c.client(t)
+	if err := member.Label("room"); err != nil {
+		t.Fatal(err)
+	}
+	a.awaitInterest(t, "c", "room")
+	if err := member.Multicast("room", []byte("local")); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, member, "room", []byte("local"))
+	for i := 0; i < 3; i++ {
+		if err := publisher.Multicast("room", []byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		// relayed frames take the label sequence of the receiving node
+		if msg := expect(t, member, "room", []byte{byte(i)}); msg.Seq != uint64(i+2) {
+			t.Fatalf("relayed frame %d has sequence %d", i, msg.Seq)
+		}
+	}
+
+	// the receiving node keeps the relayed frames in its history
+	late := c.client(t)
+	if err := late.LabelSince("room", 2); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < 3; i++ {
+		expect(t, late, "room", []byte{byte(i)})
+	}
+}
+
+func TestClusterPattern(t *testing.T) {
+	a := startNode(t, "a", "127.0.0.1:0")
+	defer a.stop()
+	b := startNode(t, "b", "127.0.0.1:0", a)
+	defer b.stop()
+
+	publisher, member := a.client(t), b.client(t)
+	if err := member.Label("news.*"); err != nil {
+		t.Fatal(err)
+	}
+	a.awaitInterest(t, "b", "news.sport")
+	if err := publisher.Multicast("weather", []byte("rain")); err != nil {
+		t.Fatal(err)
+	}
+	if err := publisher.Multicast("news.sport", []byte("goal")); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, member, "news.sport", []byte("goal"))
+	value, _ := a.server.cluster.peers.Load("b")
+	if value.(*peer).interested("weather") {
+		t.Fatal("the pattern matches an unrelated label")
+	}
+}
+
+func TestClusterRejoin(t *testing.T) {
+	a := startNode(t, "a", "127.0.0.1:0")
+	defer a.stop()
+	b := startNode(t, "b", "127.0.0.1:0", a)
+
+	publisher := a.client(t)
+	member := b.client(t)
+	if err := member.Label("room"); err != nil {
+		t.Fatal(err)
+	}
+	a.awaitInterest(t, "b", "room")
+	member.Close()
+	b.stop()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for _, ok := a.server.cluster.peers.Load("b"); ok; _, ok = a.server.cluster.peers.Load("b") {
+		if time.Now().After(deadline) {
+			t.Fatal("the node left is still a peer")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := publisher.Multicast("room", []byte("lost")); err != nil {
+		t.Fatal(err)
+	}
+
+	b = startNode(t, "b", b.cluster, a)
+	defer b.stop()
+	member = b.client(t)
+	if err := member.Label("room"); err != nil {
+		t.Fatal(err)
+	}
+	a.awaitInterest(t, "b", "room")
+	if err := publisher.Multicast("room", []byte("back")); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, member, "room", []byte("back"))
+}
+
+func TestClusterSecret(t *testing.T) {
+	if err := NewServer().EnableCluster("a", "127.0.0.1:0", nil, nil); err == nil {
+		t.Fatal("a cluster without a secret is enabled")
+	}
+	a := startNode(t, "a", "127.0.0.1:0")
+	defer a.stop()
+	intruder := NewServer()
+	if err := intruder.EnableCluster("x", "127.0.0.1:0", []string{a.cluster}, []byte("guess")); err != nil {
+		t.Fatal(err)
+	}
+	defer intruder.cluster.close()
+	time.Sleep(500 * time.Millisecond)
+	if _, ok := a.server.cluster.peers.Load("x"); ok {
+		t.Fatal("a node with a wrong secret joined")
+	}
+	if _, ok := intruder.cluster.peers.Load("a"); ok {
+		t.Fatal("a node joined a peer with a wrong secret")
+	}
+}
+
+func TestClusterRegistry(t *testing.T) {
+	a := startNode(t, "a", "127.0.0.1:0")
+	defer a.stop()
+	b := &node{server: NewServer()}
+	if err := b.server.EnableCluster("b", "127.0.0.1:0", []string{a.cluster}, clusterSecret); err != nil {
+		t.Fatal(err)
+	}
+	b.server.SetRegistry(NewRegistry()) // after the cluster, which watches the new registry
+	b.cluster = b.server.cluster.ln.Addr().String()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.addr = ln.Addr().String()
+	ln.Close()
+	go b.server.ListenAndServe(b.addr)
+	defer b.stop()
+
+	publisher, member := a.client(t), b.client(t)
+	if err := member.Label("room"); err != nil {
+		t.Fatal(err)
+	}
+	a.awaitInterest(t, "b", "room")
+	if err := publisher.Multicast("room", []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, member, "room", []byte("hello"))
+}
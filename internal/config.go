@@ -7,4 +7,24 @@ var (
 	ConnWriteTimeout  time.Duration = time.Second * 3
 	ResponseTimeout   time.Duration = time.Second * 3
 	HeartbeatInterval time.Duration = time.Second * 3
+
+	// bounds of the negotiated features
+	MinHeartbeatInterval time.Duration = time.Second
+	MaxHeartbeatInterval time.Duration = time.Second * 30
+	MaxPayloadSize       uint32        = 1 << 20
+
+	// the tolerated clock difference of a challenge proof, also the lifetime of a nonce
+	ChallengeSkew time.Duration = time.Second * 30
+
+	// payloads smaller than it are sent uncompressed
+	CompressThreshold int = 512
+
+	// a new segment of the label log is started beyond it
+	JournalSegmentSize int64 = 4 << 20
+
+	// the relayed frames waiting to be written to a connection
+	SendQueueSize int = 1024
+
+	// the times an unacknowledged multicast is sent again
+	PublishRetries int = 3
 )
@@ -1,19 +1,357 @@
 package internal
 
 import (
+	"context"
+	"errors"
 	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/NanoRed/lim/internal/protocol"
+	"github.com/NanoRed/lim/pkg/container"
+	"github.com/NanoRed/lim/pkg/logger"
+)
+
+// QueuePolicy what is done when the send queue of a slow connection is full
+type QueuePolicy uint8
+
+const (
+	QueueDropOldest QueuePolicy = iota
+	QueueDropNewest
+	QueueDisconnect
+)
+
+// the transports the connections come from
+const (
+	TransportTCP   = "tcp"
+	TransportWSS   = "wss"
+	TransportAdmin = "admin" // the tails of the admin API
 )
 
+type delivery struct {
+	label string
+	seq   uint64
+	data  []byte
+}
+
 type conn struct {
 	net.Conn
+	id        uint64
+	transport string
+	metrics   *metrics // nil for the connections not served by a Server
+	connected time.Time
+	bytesIn   uint64
+	bytesOut  uint64
+	welcome   protocol.Welcome
+	identity  *Identity
+	greeted   uint32 // set once welcomed, then the id, welcome and identity are not written any more
+	userNode  *container.SyncPoolNode
+	held      []*delivery
+	holding   bool
+	holdLimit int  // of the held data of a parked connection
+	overflow  bool // some data was not held beyond the limit
+	successor *conn
+	session   string
+	backlog   *backlog
+	parked    chan struct{} // closed once the connection of a session is parked
+	wmu       sync.Mutex
+	quiet     sync.Map // the labels and patterns the connection does not hear its own multicasts from
+	queue     chan []byte
+	policy    QueuePolicy
+	dropped   uint64
+	stopped   chan struct{} // closed when the writer exits
+	done      chan struct{} // closed by Close
+	once      sync.Once
 }
 
-func (c *conn) Write(b []byte) (n int, err error) {
-	err = c.Conn.SetWriteDeadline(time.Now().Add(ConnWriteTimeout))
-	if err != nil {
+func newConn(c net.Conn) *conn {
+	return &conn{Conn: c, done: make(chan struct{})}
+}
+
+// ConnTarget the unicast target of a single connection
+func ConnTarget(id uint64) string {
+	return "#" + strconv.FormatUint(id, 10)
+}
+
+// UserTarget the unicast target of every connection of an authenticated identity
+func UserTarget(id string) string {
+	return "@" + id
+}
+
+func parseTarget(target string) (connID uint64, userID string, err error) {
+	switch {
+	case strings.HasPrefix(target, "#"):
+		connID, err = strconv.ParseUint(target[1:], 10, 64)
+	case strings.HasPrefix(target, "@") && len(target) > 1:
+		userID = target[1:]
+	default:
+		err = errors.New("invalid target")
+	}
+	return
+}
+
+// readTimeout a negotiated connection is considered dead after missing 3 heartbeats
+func (c *conn) readTimeout() time.Duration {
+	if t := c.welcome.Heartbeat * 3; t > ConnReadDuration {
+		return t
+	}
+	return ConnReadDuration
+}
+
+// deliver write the relayed data, or keep it until release while the connection is held,
+// the data of a resumed connection goes to the one resuming it
+func (c *conn) deliver(label string, seq uint64, data []byte) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	switch {
+	case c.successor != nil:
+		c.successor.deliver(label, seq, data)
+	case !c.holding:
+		c.enqueue(data)
+	case c.holdLimit > 0 && len(c.held) >= c.holdLimit:
+		c.overflow = true
+	default:
+		c.held = append(c.held, &delivery{label, seq, data})
+	}
+}
+
+// hold defer the relayed data until release, so that a replay goes before the live traffic
+func (c *conn) hold() {
+	c.wmu.Lock()
+	c.holding = true
+	c.wmu.Unlock()
+}
+
+// release write the held data, skipping the ones of the label already replayed up to seq
+func (c *conn) release(label string, seq uint64) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	for _, d := range c.held {
+		if d.label != label || d.seq == 0 || d.seq > seq {
+			c.enqueue(d.data)
+		}
+	}
+	c.held = nil
+	c.holding = false
+}
+
+func (c *conn) welcomed() bool {
+	return atomic.LoadUint32(&c.greeted) == 1
+}
+
+// park hold the relayed data of the broken connection up to limit
+func (c *conn) park(limit int) {
+	c.wmu.Lock()
+	c.holding, c.holdLimit = true, limit
+	c.wmu.Unlock()
+}
+
+func (c *conn) overflowed() bool {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return c.overflow
+}
+
+// takeover write the missed data, what the writer of the parked connection left in its queue
+// and what it held, then release the held data but the copies of them. The parked connection
+// passes on the data delivered to it from then on
+func (c *conn) takeover(parked *conn, missed [][]byte) {
+	parked.wmu.Lock()
+	for drained := false; !drained; {
+		select {
+		case data := <-parked.queue:
+			if data != nil {
+				missed = append(missed, data)
+			}
+		default:
+			drained = true
+		}
+	}
+	held := parked.held
+	parked.held, parked.successor = nil, c
+	parked.wmu.Unlock()
+
+	// the labels were joined before the parked connection left them
+	type key struct {
+		label string
+		seq   uint64
+	}
+	seen := make(map[key]int) // the pieces of a frame share the key
+	for _, data := range missed {
+		c.push(data)
+	}
+	for _, d := range held {
+		seen[key{d.label, d.seq}]++
+		c.push(d.data)
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	for _, d := range c.held {
+		if k := (key{d.label, d.seq}); d.seq > 0 && seen[k] > 0 {
+			seen[k]--
+		} else {
+			c.enqueue(d.data)
+		}
+	}
+	c.held = nil
+	c.holding = false
+}
+
+// push wait for the room in the queue rather than applying the queue policy
+func (c *conn) push(data []byte) {
+	select {
+	case c.queue <- data:
+	case <-c.done:
+	}
+}
+
+func (c *conn) mute(label string, quiet bool) {
+	if quiet {
+		c.quiet.Store(label, nil)
+	} else {
+		c.quiet.Delete(label)
+	}
+}
+
+// muted whether the label, or a pattern matching it, was joined without echo
+func (c *conn) muted(label string) bool {
+	if _, ok := c.quiet.Load(label); ok {
+		return true
+	}
+	muted := false
+	c.quiet.Range(func(key, value any) bool {
+		muted = isPattern(key.(string)) && matchPattern(key.(string), label)
+		return !muted
+	})
+	return muted
+}
+
+// serve start the writer of the send queue, the relayed data is written
+// directly without it
+func (c *conn) serve(size int, policy QueuePolicy) {
+	c.queue = make(chan []byte, size)
+	c.policy = policy
+	c.stopped = make(chan struct{})
+	go c.writeLoop()
+}
+
+func (c *conn) writeLoop() {
+	defer close(c.stopped)
+	for {
+		select {
+		case data := <-c.queue:
+			if data == nil { // flushed
+				return
+			}
+			if _, err := c.Write(data); err != nil {
+				logger.Warn("failed to write to %s: %v", c.RemoteAddr(), err)
+				c.Close()
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *conn) enqueue(data []byte) {
+	if c.queue == nil {
+		c.Write(data)
 		return
 	}
-	n, err = c.Conn.Write(b)
+	for {
+		select {
+		case c.queue <- data:
+			return
+		default:
+		}
+		switch c.policy {
+		case QueueDropNewest:
+			c.drop()
+			return
+		case QueueDisconnect:
+			logger.Warn("disconnect the slow connection %s", c.RemoteAddr())
+			c.Close()
+			return
+		default:
+			select {
+			case <-c.queue:
+				c.drop()
+			default:
+			}
+		}
+	}
+}
+
+func (c *conn) drop() {
+	atomic.AddUint64(&c.dropped, 1)
+	if c.metrics != nil {
+		atomic.AddUint64(&c.metrics.dropped, 1)
+	}
+}
+
+// goodbye queue the close notice for a welcomed v2 connection
+func (c *conn) goodbye(reason string) {
+	if c.welcomed() && c.welcome.Version >= protocol.V2 {
+		notice := &protocol.Frame{Act: protocol.ActClose, Payload: []byte(reason)}
+		if data, err := protocol.Marshal(c.welcome.Version, notice); err == nil {
+			c.deliver("", 0, data)
+		}
+	}
+}
+
+// flush stop the writer once the queued data is written
+func (c *conn) flush(ctx context.Context) error {
+	if c.queue == nil {
+		return nil
+	}
+	select {
+	case c.queue <- nil:
+	case <-c.stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-c.stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *conn) Close() error {
+	c.once.Do(func() { close(c.done) })
+	return c.Conn.Close()
+}
+
+// read count a frame read by the server
+func (c *conn) read(act protocol.Action, size int) {
+	atomic.AddUint64(&c.bytesIn, uint64(size))
+	c.metrics.in(act, size)
+}
+
+func (c *conn) Write(b []byte) (n int, err error) {
+	if err = c.Conn.SetWriteDeadline(time.Now().Add(ConnWriteTimeout)); err == nil {
+		n, err = c.Conn.Write(b)
+	}
+	if c.metrics != nil && len(b) > 0 {
+		act := protocol.Action(b[0])
+		if c.welcome.Version < protocol.V2 {
+			act >>= 6
+		}
+		if c.backlog != nil && (act == protocol.ActMulticast || act == protocol.ActUnicast) {
+			c.backlog.keep(b, err == nil)
+		}
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			atomic.AddUint64(&c.metrics.writeTimeouts, 1)
+		} else if err == nil {
+			atomic.AddUint64(&c.bytesOut, uint64(n))
+			c.metrics.out(act, n)
+		}
+	}
 	return
 }
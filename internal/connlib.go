@@ -4,16 +4,39 @@ import (
 	"errors"
 	"fmt"
 	"sync"
+	"sync/atomic"
 
 	"github.com/NanoRed/lim/pkg/container"
 )
 
-var _connlib = &connLibrary{
-	connLabel: &sync.Map{},
-	labelConn: &sync.Map{},
-	gcpool: &sync.Pool{New: func() any {
-		return &pool{SyncPool: container.NewSyncPool()}
-	}},
+// Registry keep the connections of a server and the labels they joined,
+// an alternative such as a sharded one is set with Server.SetRegistry
+type Registry interface {
+	register(conn *conn)
+	remove(conn *conn)
+	label(conn *conn, label string) error
+	dislabel(conn *conn, label string) error
+	members(label string, f func(conn *conn, pattern bool)) // every member once, including the ones of the matching patterns
+	has(label string) bool                                  // whether the label or pattern has members
+	size(label string) int                                  // the members joined to exactly the label or pattern
+	conn(id uint64) (*conn, error)
+	user(id string) (*pool, error)
+	labels() []string
+	joined(conn *conn) []string // the labels and patterns of the connection
+	watch(f func(label string)) // f is called when the members of a label change
+}
+
+func NewRegistry() Registry {
+	return &connLibrary{
+		connLabel: &sync.Map{},
+		labelConn: &sync.Map{},
+		idConn:    &sync.Map{},
+		userConn:  &sync.Map{},
+		patterns:  newTrie(),
+		gcpool: &sync.Pool{New: func() any {
+			return &pool{SyncPool: container.NewSyncPool()}
+		}},
+	}
 }
 
 type pool struct {
@@ -24,81 +47,104 @@ type pool struct {
 type connLibrary struct {
 	connLabel *sync.Map
 	labelConn *sync.Map
+	idConn    *sync.Map
+	userConn  *sync.Map
+	patterns  *trie
 	gcpool    *sync.Pool
+	lastID    uint64
+	watcher   func(label string)
 }
 
 func (c *connLibrary) register(conn *conn) {
-	c.connLabel.LoadOrStore(conn, &sync.Map{})
+	if _, loaded := c.connLabel.LoadOrStore(conn, &sync.Map{}); !loaded {
+		if conn.id == 0 { // a resuming connection keeps the ID of the parked one
+			conn.id = atomic.AddUint64(&c.lastID, 1)
+		}
+		c.idConn.Store(conn.id, conn)
+		conn.userNode = c.join(c.userConn, conn.identity.ID, conn)
+	}
 }
 
 func (c *connLibrary) remove(conn *conn) {
 	if v, loaded := c.connLabel.LoadAndDelete(conn); loaded {
 		v.(*sync.Map).Range(func(label, node interface{}) bool {
-			if p, ok := c.labelConn.Load(label); ok {
-				pool := p.(*pool)
-				pool.Remove(node.(*container.SyncPoolNode))
-				if pool.Entry() == nil {
-					pool.rwmu.Lock()
-					if pool.Entry() == nil {
-						if p, ok := c.labelConn.Load(label); ok && p == pool {
-							c.labelConn.Delete(label)
-						}
-						// c.labelConn.CompareAndDelete(label, pool)
-						pool.rwmu.Unlock()
-						c.gcpool.Put(pool)
-					} else {
-						pool.rwmu.Unlock()
-					}
-				}
-			}
+			c.unindex(label.(string), node.(*container.SyncPoolNode))
+			c.changed(label.(string))
 			return true
 		})
+		if v, ok := c.idConn.Load(conn.id); ok && v == conn {
+			c.idConn.Delete(conn.id)
+		}
+		c.leave(c.userConn, conn.identity.ID, conn.userNode)
 		conn.Close()
 	}
 }
 
-func (c *connLibrary) label(conn *conn, label string) error {
-	v, ok := c.connLabel.Load(conn)
-	if !ok {
-		return errors.New("connection has been removed")
-	}
-	smap := v.(*sync.Map)
-	if _, ok := smap.Load(label); ok {
-		return errors.New("connection label has been existed")
-	}
+// join add the connection into the pool of the key, the pool is created on demand
+func (c *connLibrary) join(m *sync.Map, key any, conn *conn) *container.SyncPoolNode {
 GETPOOL:
 	p := c.gcpool.Get()
-	v, loaded := c.labelConn.LoadOrStore(label, p)
+	v, loaded := m.LoadOrStore(key, p)
 	if loaded {
 		c.gcpool.Put(p)
 	}
 	pool := v.(*pool)
 	pool.rwmu.RLock()
-	if v2, _ := c.labelConn.Load(label); v != v2 {
+	if v2, _ := m.Load(key); v != v2 {
 		pool.rwmu.RUnlock()
 		goto GETPOOL
 	}
 	nnode := pool.Add(conn)
 	pool.rwmu.RUnlock()
-	smap.Store(label, nnode)
-	// connection valid check
-	if _, ok = c.connLabel.Load(conn); !ok {
-		pool.Remove(nnode)
+	return nnode
+}
+
+// leave remove the node from the pool of the key, the pool is recycled once it is empty
+func (c *connLibrary) leave(m *sync.Map, key any, node *container.SyncPoolNode) {
+	if p, ok := m.Load(key); ok {
+		pool := p.(*pool)
+		pool.Remove(node)
 		if pool.Entry() == nil {
 			pool.rwmu.Lock()
 			if pool.Entry() == nil {
-				if p, ok := c.labelConn.Load(label); ok && p == pool {
-					c.labelConn.Delete(label)
+				if p, ok := m.Load(key); ok && p == pool {
+					m.Delete(key)
 				}
-				// c.labelConn.CompareAndDelete(label, pool)
+				// m.CompareAndDelete(key, pool)
 				pool.rwmu.Unlock()
 				c.gcpool.Put(pool)
 			} else {
 				pool.rwmu.Unlock()
 			}
 		}
+	}
+}
+
+func (c *connLibrary) label(conn *conn, label string) error {
+	v, ok := c.connLabel.Load(conn)
+	if !ok {
+		return errors.New("connection has been removed")
+	}
+	smap := v.(*sync.Map)
+	if _, ok := smap.Load(label); ok {
+		return errors.New("connection label has been existed")
+	}
+	var nnode *container.SyncPoolNode
+	if isPattern(label) {
+		if err := validPattern(label); err != nil {
+			return err
+		}
+		nnode = c.patterns.add(label, conn)
+	} else {
+		nnode = c.join(c.labelConn, label, conn)
+	}
+	smap.Store(label, nnode)
+	// connection valid check
+	if _, ok = c.connLabel.Load(conn); !ok {
+		c.unindex(label, nnode)
 		return errors.New("connection has been removed")
 	}
+	c.changed(label)
 	return nil
 }
 
@@ -112,29 +158,107 @@ func (c *connLibrary) dislabel(conn *conn, label string) error {
 	if !ok {
 		return errors.New("connection label does not exist")
 	}
+	smap.Delete(label)
+	c.unindex(label, node.(*container.SyncPoolNode))
+	c.changed(label)
+	return nil
+}
+
+// unindex take the member node of the label or pattern out of its pool
+func (c *connLibrary) unindex(label string, node *container.SyncPoolNode) {
+	if isPattern(label) {
+		c.patterns.remove(label, node)
+	} else {
+		c.leave(c.labelConn, label, node)
+	}
+}
+
+func (c *connLibrary) watch(f func(label string)) {
+	c.watcher = f
+}
+
+func (c *connLibrary) changed(label string) {
+	if c.watcher != nil {
+		c.watcher(label)
+	}
+}
+
+// labels every label and pattern with members
+func (c *connLibrary) labels() (labels []string) {
+	c.labelConn.Range(func(key, value any) bool {
+		labels = append(labels, key.(string))
+		return true
+	})
+	return append(labels, c.patterns.patterns()...)
+}
+
+func (c *connLibrary) joined(conn *conn) (labels []string) {
+	if v, ok := c.connLabel.Load(conn); ok {
+		v.(*sync.Map).Range(func(key, value any) bool {
+			labels = append(labels, key.(string))
+			return true
+		})
+	}
+	return
+}
+
+// members the exact members go first, so that pattern is only true for the
+// connections which joined none but a pattern matching the label
+func (c *connLibrary) members(label string, f func(conn *conn, pattern bool)) {
+	var pools []*pool
 	if p, ok := c.labelConn.Load(label); ok {
-		pool := p.(*pool)
-		pool.Remove(node.(*container.SyncPoolNode))
-		if pool.Entry() == nil {
-			pool.rwmu.Lock()
-			if pool.Entry() == nil {
-				if p, ok := c.labelConn.Load(label); ok && p == pool {
-					c.labelConn.Delete(label)
-				}
-				// c.labelConn.CompareAndDelete(label, pool)
-				pool.rwmu.Unlock()
-				c.gcpool.Put(pool)
-			} else {
-				pool.rwmu.Unlock()
+		pools = append(pools, p.(*pool))
+	}
+	exact := len(pools)
+	pools = append(pools, c.patterns.match(label)...)
+	if len(pools) == 1 {
+		for current := pools[0].Entry(); current != nil; current = current.Next() {
+			f(current.Load().(*conn), exact == 0)
+		}
+		return
+	}
+	seen := make(map[*conn]struct{})
+	for i, pool := range pools {
+		for current := pool.Entry(); current != nil; current = current.Next() {
+			conn := current.Load().(*conn)
+			if _, ok := seen[conn]; !ok {
+				seen[conn] = struct{}{}
+				f(conn, i >= exact)
 			}
 		}
 	}
-	return nil
 }
 
-func (c *connLibrary) pool(label string) (*pool, error) {
+func (c *connLibrary) size(label string) (n int) {
+	if isPattern(label) {
+		return c.patterns.size(label)
+	}
 	if p, ok := c.labelConn.Load(label); ok {
+		for current := p.(*pool).Entry(); current != nil; current = current.Next() {
+			n++
+		}
+	}
+	return
+}
+
+func (c *connLibrary) has(label string) bool {
+	if isPattern(label) {
+		return c.patterns.has(label)
+	}
+	_, ok := c.labelConn.Load(label)
+	return ok
+}
+
+func (c *connLibrary) conn(id uint64) (*conn, error) {
+	if v, ok := c.idConn.Load(id); ok {
+		return v.(*conn), nil
+	}
+	return nil, fmt.Errorf("failed to get corresponding connection: %d", id)
+}
+
+func (c *connLibrary) user(id string) (*pool, error) {
+	if p, ok := c.userConn.Load(id); ok {
 		return p.(*pool), nil
 	}
-	return nil, fmt.Errorf("failed to get corresponding connection pool: %s", label)
+	return nil, fmt.Errorf("failed to get corresponding user connections: %s", id)
 }
@@ -0,0 +1,113 @@
+package internal
+
+import (
+	"sync"
+
+	"github.com/NanoRed/lim/internal/protocol"
+)
+
+type variant struct {
+	version     protocol.Version
+	compression string
+	max         int // the payload size the data is separated into, 0 for the frame as is
+}
+
+type encoding struct {
+	data [][]byte // a frame, or the pieces of it
+	size int      // the largest payload size
+	err  error
+}
+
+// fanout encode a relayed frame at most once for every kind of receiving connection,
+// a compressed payload is only inflated for the connections which did not negotiate
+// the same compression. The data too large for a connection is separated into pieces
+// its packer assembles
+type fanout struct {
+	frame    protocol.Frame
+	source   variant
+	encoded  map[variant]*encoding
+	inflated *protocol.Frame
+	mu       sync.Mutex
+}
+
+// newFanout the fanout of a frame received from the connection
+func newFanout(frame *protocol.Frame, from *conn) *fanout {
+	f := &fanout{
+		frame:   *frame,
+		source:  variant{version: from.welcome.Version},
+		encoded: make(map[variant]*encoding),
+	}
+	if frame.Flags&protocol.FlagCompressed > 0 {
+		f.source.compression = from.welcome.Compression
+	}
+	return f
+}
+
+// newStoredFanout the fanout of a frame read back from the journal
+func newStoredFanout(frame *protocol.Frame, compression string) *fanout {
+	return &fanout{
+		frame:   *frame,
+		source:  variant{version: protocol.V2, compression: compression},
+		encoded: make(map[variant]*encoding),
+	}
+}
+
+func (f *fanout) encode(conn *conn) ([][]byte, error) {
+	v := variant{version: conn.welcome.Version, compression: conn.welcome.Compression}
+	e := f.variant(v)
+	if e.err != nil || e.size > int(conn.welcome.MaxPayload) { // v1 does not encode a large payload at all
+		v.compression, v.max = "", int(conn.welcome.MaxPayload)
+		e = f.variant(v)
+	}
+	return e.data, e.err
+}
+
+// variant the encoding for the kind of connections, the compression of the
+// kind is ignored unless it is the same as the source one
+func (f *fanout) variant(v variant) *encoding {
+	if v.compression != f.source.compression {
+		v.compression = ""
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	e, ok := f.encoded[v]
+	if !ok {
+		e = f.reencode(v)
+		f.encoded[v] = e
+	}
+	return e
+}
+
+func (f *fanout) reencode(v variant) *encoding {
+	frame := &f.frame
+	if v.compression != f.source.compression {
+		if f.inflated == nil {
+			f.inflated = &protocol.Frame{}
+			*f.inflated = f.frame
+			if err := protocol.Decompress(f.source.compression, f.inflated, int(MaxPayloadSize)); err != nil {
+				return &encoding{err: err}
+			}
+		}
+		frame = f.inflated
+	}
+	if v.max == 0 {
+		data, err := protocol.Marshal(v.version, frame)
+		return &encoding{[][]byte{data}, len(frame.Payload), err}
+	}
+	pieces, err := protocol.Split(frame, v.max)
+	if err != nil {
+		return &encoding{err: err}
+	}
+	e := &encoding{data: make([][]byte, 0, len(pieces))}
+	for _, piece := range pieces {
+		data, err := protocol.Marshal(v.version, piece)
+		if err != nil {
+			return &encoding{err: err}
+		}
+		e.data = append(e.data, data)
+		if len(piece.Payload) > e.size {
+			e.size = len(piece.Payload)
+		}
+	}
+	return e
+}
@@ -0,0 +1,81 @@
+package internal
+
+import (
+	"sync"
+	"time"
+)
+
+type record struct {
+	seq    uint64
+	at     time.Time
+	fanout *fanout
+}
+
+// ring the latest records of a label, oldest first
+type ring struct {
+	records []*record
+	head    int
+	mu      sync.Mutex
+}
+
+// history keep the last size messages of every label not older than ttl,
+// zero means no limit on that dimension
+type history struct {
+	size   int
+	ttl    time.Duration
+	labels *sync.Map
+}
+
+func newHistory(size int, ttl time.Duration) *history {
+	return &history{size: size, ttl: ttl, labels: &sync.Map{}}
+}
+
+func (h *history) record(label string, seq uint64, fanout *fanout) {
+	v, ok := h.labels.Load(label)
+	if !ok {
+		v, _ = h.labels.LoadOrStore(label, &ring{})
+	}
+	r := v.(*ring)
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.expire(now, h.ttl)
+	rec := &record{seq, now, fanout}
+	if h.size > 0 && len(r.records)-r.head >= h.size {
+		r.records[r.head] = nil
+		r.head++
+	}
+	r.records = append(r.records, rec)
+	if r.head > len(r.records)/2 { // compact
+		r.records = append(r.records[:0:0], r.records[r.head:]...)
+		r.head = 0
+	}
+}
+
+// since the records of the label with a sequence number after seq
+func (h *history) since(label string, seq uint64) []*record {
+	v, ok := h.labels.Load(label)
+	if !ok {
+		return nil
+	}
+	r := v.(*ring)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.expire(time.Now(), h.ttl)
+	records := make([]*record, 0, len(r.records)-r.head)
+	for _, rec := range r.records[r.head:] {
+		if rec.seq > seq {
+			records = append(records, rec)
+		}
+	}
+	return records
+}
+
+func (r *ring) expire(now time.Time, ttl time.Duration) {
+	if ttl > 0 {
+		for r.head < len(r.records) && now.Sub(r.records[r.head].at) > ttl {
+			r.records[r.head] = nil
+			r.head++
+		}
+	}
+}
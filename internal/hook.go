@@ -0,0 +1,106 @@
+package internal
+
+import (
+	"net"
+
+	"github.com/NanoRed/lim/internal/protocol"
+)
+
+// ConnInfo what the hooks know about a connection
+type ConnInfo struct {
+	ID         uint64
+	Identity   *Identity
+	RemoteAddr net.Addr
+}
+
+// Hook the middleware run by Server.handle, any of the functions may be nil.
+// A returned error denies the operation and its message is sent back in the response,
+// a multicast is answered only when it asks for an acknowledgement (Client.MulticastAck)
+type Hook struct {
+	OnConnect    func(info ConnInfo) error
+	OnDisconnect func(info ConnInfo)
+	OnLabel      func(info ConnInfo, label string) error
+	OnDislabel   func(info ConnInfo, label string) error
+	// OnMulticast sees the payload as the data sent without the header of the packer, the data
+	// separated into pieces is seen piece by piece. The label and payload may be rewritten
+	OnMulticast func(info ConnInfo, frame *protocol.Frame) error
+}
+
+type hooks []*Hook
+
+// denied an operation rejected by a hook, a typed error of the hook is kept as is
+func denied(err error) error {
+	if _, ok := err.(*protocol.Error); ok {
+		return err
+	}
+	return &protocol.Error{Code: protocol.CodeDenied, Message: err.Error()}
+}
+
+func (c *conn) info() ConnInfo {
+	return ConnInfo{c.id, c.identity, c.RemoteAddr()}
+}
+
+func (h hooks) connect(conn *conn) error {
+	for _, hook := range h {
+		if hook.OnConnect != nil {
+			if err := hook.OnConnect(conn.info()); err != nil {
+				return denied(err)
+			}
+		}
+	}
+	return nil
+}
+
+func (h hooks) disconnect(conn *conn) {
+	for _, hook := range h {
+		if hook.OnDisconnect != nil {
+			hook.OnDisconnect(conn.info())
+		}
+	}
+}
+
+func (h hooks) label(conn *conn, label string) error {
+	for _, hook := range h {
+		if hook.OnLabel != nil {
+			if err := hook.OnLabel(conn.info(), label); err != nil {
+				return denied(err)
+			}
+		}
+	}
+	return nil
+}
+
+func (h hooks) dislabel(conn *conn, label string) error {
+	for _, hook := range h {
+		if hook.OnDislabel != nil {
+			if err := hook.OnDislabel(conn.info(), label); err != nil {
+				return denied(err)
+			}
+		}
+	}
+	return nil
+}
+
+// multicast run the multicast hooks on the inflated data, the header of the packer
+// is put back before the payload rewritten by the hooks
+func (h hooks) multicast(conn *conn, frame *protocol.Frame) (err error) {
+	var header []byte
+	for _, hook := range h {
+		if hook.OnMulticast == nil {
+			continue
+		}
+		if header == nil {
+			if err = protocol.Decompress(conn.welcome.Compression, frame, int(conn.welcome.MaxPayload)); err != nil {
+				return
+			}
+			if header, frame.Payload, err = protocol.Unpack(frame.Payload); err != nil {
+				return
+			}
+			defer func() { frame.Payload = append(header, frame.Payload...) }()
+		}
+		if err = hook.OnMulticast(conn.info(), frame); err != nil {
+			return denied(err)
+		}
+	}
+	return
+}
@@ -0,0 +1,41 @@
+package internal
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/NanoRed/lim/internal/protocol"
+)
+
+func TestHookMulticast(t *testing.T) {
+	seen := make(chan []byte, 1)
+	server := NewServer()
+	server.Use(&Hook{OnMulticast: func(info ConnInfo, frame *protocol.Frame) error {
+		seen <- append([]byte(nil), frame.Payload...)
+		frame.Payload = bytes.ToUpper(frame.Payload)
+		return nil
+	}})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	go server.ListenAndServe(addr)
+	node := &node{server: server, addr: addr}
+	defer node.stop()
+
+	client := node.client(t)
+	if err := client.Label("room"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Multicast("room", []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	// the hook sees the data without the header of the packer, which the receiver still gets
+	expect(t, client, "room", []byte("HELLO"))
+	if data := <-seen; !bytes.Equal(data, []byte("hello")) {
+		t.Fatalf("the hook saw %q", data)
+	}
+}
@@ -0,0 +1,399 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NanoRed/lim/internal/protocol"
+	"github.com/NanoRed/lim/pkg/logger"
+)
+
+const (
+	segmentSuffix = ".seg"
+	cursorsFile   = "cursors.json"
+	labelFile     = "label" // in the directory of a label, which is named by the hash of the label
+)
+
+type segment struct {
+	start   uint64
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// labelLog the segments of a label, oldest first, the last one is appended
+type labelLog struct {
+	dir      string
+	segments []*segment
+	tail     *os.File
+	last     uint64
+	mu       sync.Mutex
+}
+
+// journal append-only segment logs of every label on the local disk,
+// a record: size uvarint | seq uvarint | compression size 1B | compression | v2 frame
+type journal struct {
+	dir      string
+	maxBytes int64         // per label, zero means no limit
+	maxAge   time.Duration // zero means no limit
+	labels   *sync.Map
+	cursors  *cursors
+}
+
+func openJournal(dir string, maxBytes int64, maxAge time.Duration) (*journal, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	j := &journal{dir: dir, maxBytes: maxBytes, maxAge: maxAge, labels: &sync.Map{}}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		label, err := os.ReadFile(filepath.Join(dir, entry.Name(), labelFile))
+		if err != nil {
+			logger.Warn("skip the journal directory %s: %v", entry.Name(), err)
+			continue
+		}
+		if entry.Name() != labelDir(string(label)) {
+			logger.Warn("skip the journal directory %s: it is not named for its label", entry.Name())
+			continue
+		}
+		l, err := openLabelLog(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to open the log of %s: %w", label, err)
+		}
+		j.labels.Store(string(label), l)
+	}
+	if j.cursors, err = loadCursors(filepath.Join(dir, cursorsFile)); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+func openLabelLog(dir string) (*labelLog, error) {
+	l := &labelLog{dir: dir}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+		start, err := strconv.ParseUint(strings.TrimSuffix(name, segmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		l.segments = append(l.segments, &segment{start, filepath.Join(dir, name), info.Size(), info.ModTime()})
+	}
+	sort.Slice(l.segments, func(i, k int) bool { return l.segments[i].start < l.segments[k].start })
+	if n := len(l.segments); n > 0 {
+		// find the last sequence and cut off a record torn by a crash
+		tail := l.segments[n-1]
+		var valid int64
+		err := readSegment(tail.path, func(seq uint64, offset int64, compression string, frame *protocol.Frame) bool {
+			l.last, valid = seq, offset
+			return true
+		})
+		if err != nil {
+			logger.Warn("truncate the torn segment %s at %d: %v", tail.path, valid, err)
+			if err = os.Truncate(tail.path, valid); err != nil {
+				return nil, err
+			}
+			tail.size = valid
+		}
+	}
+	return l, nil
+}
+
+// readSegment call f with every record of the segment and the offset after it
+func readSegment(path string, f func(seq uint64, offset int64, compression string, frame *protocol.Frame) bool) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	r := bufio.NewReader(file)
+	var offset int64
+	for {
+		size, err := binary.ReadUvarint(r)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		rec := make([]byte, size)
+		if _, err = io.ReadFull(r, rec); err != nil {
+			return err
+		}
+		seq, n := binary.Uvarint(rec)
+		if n <= 0 || len(rec) < n+1 || len(rec) < n+1+int(rec[n]) {
+			return errors.New("malformed record")
+		}
+		compression := string(rec[n+1 : n+1+int(rec[n])])
+		frame := &protocol.Frame{}
+		decoder := protocol.NewFrameDecoder(bytes.NewReader(rec[n+1+int(rec[n]):]))
+		decoder.SetVersion(protocol.V2)
+		if _, err = decoder.Decode(frame); err != nil {
+			return err
+		}
+		offset += int64(binary.PutUvarint(make([]byte, binary.MaxVarintLen64), size)) + int64(size)
+		if !f(seq, offset, compression, frame) {
+			return nil
+		}
+	}
+}
+
+func (j *journal) labelLog(label string) (*labelLog, error) {
+	if v, ok := j.labels.Load(label); ok {
+		return v.(*labelLog), nil
+	}
+	dir := filepath.Join(j.dir, labelDir(label))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(dir, labelFile), []byte(label), 0644); err != nil {
+		return nil, err
+	}
+	v, _ := j.labels.LoadOrStore(label, &labelLog{dir: dir})
+	return v.(*labelLog), nil
+}
+
+// labelDir the directory name of a label, a fixed-length hash as a label may be longer than a file name
+func labelDir(label string) string {
+	sum := sha256.Sum256([]byte(label))
+	return hex.EncodeToString(sum[:])
+}
+
+func (j *journal) append(label string, seq uint64, fanout *fanout) error {
+	data, err := protocol.Marshal(protocol.V2, &fanout.frame)
+	if err != nil {
+		return err
+	}
+	rec := binary.AppendUvarint(nil, seq)
+	rec = append(rec, byte(len(fanout.source.compression)))
+	rec = append(rec, fanout.source.compression...)
+	rec = append(rec, data...)
+	rec = append(binary.AppendUvarint(nil, uint64(len(rec))), rec...)
+	l, err := j.labelLog(label)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.tail == nil || l.segments[len(l.segments)-1].size >= JournalSegmentSize {
+		if err = l.rotate(seq); err != nil {
+			return err
+		}
+		l.retain(j.maxBytes, j.maxAge)
+	}
+	if _, err = l.tail.Write(rec); err != nil {
+		return err
+	}
+	tail := l.segments[len(l.segments)-1]
+	tail.size += int64(len(rec))
+	tail.modTime = time.Now()
+	l.last = seq
+	return nil
+}
+
+// rotate open a new tail segment starting from seq
+func (l *labelLog) rotate(seq uint64) (err error) {
+	if l.tail != nil {
+		l.tail.Close()
+		l.tail = nil
+	}
+	if n := len(l.segments); n > 0 && l.segments[n-1].size < JournalSegmentSize {
+		// reopen the tail left by the last run
+		l.tail, err = os.OpenFile(l.segments[n-1].path, os.O_WRONLY|os.O_APPEND, 0644)
+		return
+	}
+	path := filepath.Join(l.dir, fmt.Sprintf("%020d%s", seq, segmentSuffix))
+	if l.tail, err = os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+		return
+	}
+	l.segments = append(l.segments, &segment{seq, path, 0, time.Now()})
+	return
+}
+
+// retain remove the oldest segments beyond the limits, the tail is always kept
+func (l *labelLog) retain(maxBytes int64, maxAge time.Duration) {
+	var total int64
+	for _, seg := range l.segments {
+		total += seg.size
+	}
+	for len(l.segments) > 1 {
+		oldest := l.segments[0]
+		if (maxBytes <= 0 || total <= maxBytes) && (maxAge <= 0 || time.Since(oldest.modTime) <= maxAge) {
+			break
+		}
+		if err := os.Remove(oldest.path); err != nil {
+			logger.Error("failed to remove the segment %s: %v", oldest.path, err)
+			break
+		}
+		total -= oldest.size
+		l.segments = l.segments[1:]
+	}
+}
+
+// since call f with the records of the label with a sequence number after seq one by one,
+// oldest first, until f returns false
+func (j *journal) since(label string, seq uint64, f func(rec *record) bool) error {
+	v, ok := j.labels.Load(label)
+	if !ok {
+		return nil
+	}
+	l := v.(*labelLog)
+	l.mu.Lock()
+	segments := make([]*segment, 0, len(l.segments))
+	for i, seg := range l.segments {
+		if i+1 < len(l.segments) && l.segments[i+1].start <= seq+1 {
+			continue
+		}
+		segments = append(segments, seg)
+	}
+	l.mu.Unlock()
+	more := true
+	for _, seg := range segments {
+		err := readSegment(seg.path, func(s uint64, offset int64, compression string, frame *protocol.Frame) bool {
+			if s > seq {
+				more = f(&record{s, seg.modTime, newStoredFanout(frame, compression)})
+			}
+			return more
+		})
+		// the tail may be in the middle of an append
+		if err != nil && !errors.Is(err, os.ErrNotExist) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			return err
+		}
+		if !more {
+			break
+		}
+	}
+	return nil
+}
+
+// recover call f with the last sequence of every label
+func (j *journal) recover(f func(label string, last uint64)) {
+	j.labels.Range(func(key, value any) bool {
+		f(key.(string), value.(*labelLog).last)
+		return true
+	})
+}
+
+func (j *journal) close() error {
+	j.labels.Range(func(key, value any) bool {
+		l := value.(*labelLog)
+		l.mu.Lock()
+		if l.tail != nil {
+			l.tail.Close()
+			l.tail = nil
+		}
+		l.mu.Unlock()
+		return true
+	})
+	return j.cursors.close()
+}
+
+// cursors the last acknowledged sequence of every identity on every label,
+// they are flushed to the file in the background
+type cursors struct {
+	path  string
+	seqs  map[string]map[string]uint64
+	dirty bool
+	done  chan struct{}
+	mu    sync.Mutex
+}
+
+func loadCursors(path string) (*cursors, error) {
+	c := &cursors{path: path, seqs: make(map[string]map[string]uint64), done: make(chan struct{})}
+	if data, err := os.ReadFile(path); err == nil {
+		if err = json.Unmarshal(data, &c.seqs); err != nil {
+			return nil, fmt.Errorf("failed to load the cursors: %w", err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := c.flush(); err != nil {
+					logger.Error("failed to flush the cursors: %v", err)
+				}
+			case <-c.done:
+				return
+			}
+		}
+	}()
+	return c, nil
+}
+
+func (c *cursors) ack(id, label string, seq uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	labels, ok := c.seqs[id]
+	if !ok {
+		labels = make(map[string]uint64)
+		c.seqs[id] = labels
+	}
+	if seq > labels[label] {
+		labels[label] = seq
+		c.dirty = true
+	}
+}
+
+func (c *cursors) cursor(id, label string) (seq uint64, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	seq, ok = c.seqs[id][label]
+	return
+}
+
+func (c *cursors) flush() error {
+	c.mu.Lock()
+	if !c.dirty {
+		c.mu.Unlock()
+		return nil
+	}
+	data, err := json.Marshal(c.seqs)
+	c.dirty = false
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp := c.path + ".tmp"
+	if err = os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.path)
+}
+
+func (c *cursors) close() error {
+	close(c.done)
+	return c.flush()
+}
@@ -0,0 +1,60 @@
+package internal
+
+import (
+	"net"
+	"testing"
+)
+
+func startJournal(t *testing.T, dir string) *node {
+	t.Helper()
+	server := NewServer()
+	server.EnableHistory(4, 0)
+	if err := server.EnableJournal(dir, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	go server.ListenAndServe(addr)
+	return &node{server: server, addr: addr}
+}
+
+func TestJournalRecover(t *testing.T) {
+	dir := t.TempDir()
+	first := startJournal(t, dir)
+	publisher := first.client(t)
+	for i := 1; i <= 10; i++ {
+		if _, err := publisher.MulticastAck("room", []byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	publisher.Close()
+	first.stop()
+
+	second := startJournal(t, dir)
+	defer second.stop()
+	// the history is seeded with the records it keeps only
+	if records := second.server.history.since("room", 0); len(records) != 4 || records[0].seq != 7 {
+		t.Fatalf("the history keeps %d records", len(records))
+	}
+	// the journal replays every record after the sequence asked for
+	late := second.client(t)
+	if err := late.LabelSince("room", 5); err != nil {
+		t.Fatal(err)
+	}
+	for i := 6; i <= 10; i++ {
+		if msg := expect(t, late, "room", []byte{byte(i)}); msg.Seq != uint64(i) {
+			t.Fatalf("replayed frame %d has sequence %d", i, msg.Seq)
+		}
+	}
+	publisher = second.client(t)
+	if _, err := publisher.MulticastAck("room", []byte{11}); err != nil {
+		t.Fatal(err)
+	}
+	if msg := expect(t, late, "room", []byte{11}); msg.Seq != 11 {
+		t.Fatalf("the sequence %d does not follow the journal", msg.Seq)
+	}
+}
@@ -0,0 +1,159 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/NanoRed/lim/internal/protocol"
+	"github.com/NanoRed/lim/internal/websocket"
+	"github.com/NanoRed/lim/pkg/logger"
+)
+
+// labelEscaper the escapes of a label value in the text format, which are not the ones of Go
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// the upper bounds in seconds of the fan-out latency histogram
+var fanoutBuckets = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1}
+
+// metrics the counters exposed in the Prometheus text format
+type metrics struct {
+	framesIn          [256]uint64 // by action
+	bytesIn           [256]uint64
+	framesOut         [256]uint64
+	bytesOut          [256]uint64
+	handshakeFailures uint64
+	writeTimeouts     uint64
+	dropped           uint64
+	fanoutCounts      []uint64 // by bucket, plus the one of +Inf
+	fanoutSum         uint64   // nanoseconds
+}
+
+func newMetrics() *metrics {
+	return &metrics{fanoutCounts: make([]uint64, len(fanoutBuckets)+1)}
+}
+
+func (m *metrics) in(act protocol.Action, size int) {
+	atomic.AddUint64(&m.framesIn[act], 1)
+	atomic.AddUint64(&m.bytesIn[act], uint64(size))
+}
+
+func (m *metrics) out(act protocol.Action, size int) {
+	atomic.AddUint64(&m.framesOut[act], 1)
+	atomic.AddUint64(&m.bytesOut[act], uint64(size))
+}
+
+func (m *metrics) fanout(d time.Duration) {
+	i := sort.SearchFloat64s(fanoutBuckets, d.Seconds())
+	atomic.AddUint64(&m.fanoutCounts[i], 1)
+	atomic.AddUint64(&m.fanoutSum, uint64(d))
+}
+
+// EnableMetrics serve the metrics at http://addr/metrics
+func (s *Server) EnableMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		s.writeMetrics(w)
+	})
+	server := &http.Server{Addr: addr, Handler: mux}
+	if !s.serve("metrics", server) {
+		return
+	}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && !s.closing() {
+			logger.Error("metrics server error: %v", err)
+		}
+	}()
+}
+
+// transports the welcomed connections by transport
+func (s *Server) transports() map[string]int {
+	transports := map[string]int{TransportTCP: 0, TransportWSS: 0}
+	s.conns.Range(func(key, value any) bool {
+		if conn := key.(*conn); conn.welcomed() {
+			transports[conn.transport]++
+		}
+		return true
+	})
+	return transports
+}
+
+func (s *Server) writeMetrics(w io.Writer) {
+	m := s.metrics
+	transports := s.transports()
+	header(w, "lim_connections", "gauge", "The established connections by transport.")
+	for _, transport := range []string{TransportTCP, TransportWSS} {
+		fmt.Fprintf(w, "lim_connections{transport=%s} %d\n", labelValue(transport), transports[transport])
+	}
+
+	labels := s.registry.labels()
+	sort.Strings(labels)
+	header(w, "lim_labels", "gauge", "The labels and patterns with members.")
+	fmt.Fprintf(w, "lim_labels %d\n", len(labels))
+	header(w, "lim_label_members", "gauge", "The members of every label or pattern.")
+	for _, label := range labels {
+		fmt.Fprintf(w, "lim_label_members{label=%s} %d\n", labelValue(label), s.registry.size(label))
+	}
+
+	header(w, "lim_frames_total", "counter", "The frames read and written by action.")
+	for act := range m.framesIn {
+		writeDirections(w, "lim_frames_total", protocol.Action(act), &m.framesIn[act], &m.framesOut[act])
+	}
+	header(w, "lim_bytes_total", "counter", "The frame bytes read and written by action.")
+	for act := range m.bytesIn {
+		writeDirections(w, "lim_bytes_total", protocol.Action(act), &m.bytesIn[act], &m.bytesOut[act])
+	}
+
+	header(w, "lim_handshake_failures_total", "counter", "The handshakes failed or denied.")
+	fmt.Fprintf(w, "lim_handshake_failures_total %d\n", atomic.LoadUint64(&m.handshakeFailures))
+	header(w, "lim_write_timeouts_total", "counter", "The writes to a connection timed out.")
+	fmt.Fprintf(w, "lim_write_timeouts_total %d\n", atomic.LoadUint64(&m.writeTimeouts))
+	header(w, "lim_dropped_frames_total", "counter", "The frames dropped from the send queue of a slow connection.")
+	fmt.Fprintf(w, "lim_dropped_frames_total %d\n", atomic.LoadUint64(&m.dropped))
+
+	if wss, ok := s.server("wss").(*websocket.Server); ok {
+		upgrades, failures := wss.Stats()
+		header(w, "lim_websocket_upgrades_total", "counter", "The websocket upgrades by result.")
+		fmt.Fprintf(w, "lim_websocket_upgrades_total{result=\"ok\"} %d\n", upgrades)
+		fmt.Fprintf(w, "lim_websocket_upgrades_total{result=\"failed\"} %d\n", failures)
+	}
+
+	header(w, "lim_fanout_duration_seconds", "histogram", "The time to queue a multicast for every member.")
+	var count uint64
+	for i, bound := range fanoutBuckets {
+		count += atomic.LoadUint64(&m.fanoutCounts[i])
+		fmt.Fprintf(w, "lim_fanout_duration_seconds_bucket{le=%s} %d\n", labelValue(strconv.FormatFloat(bound, 'g', -1, 64)), count)
+	}
+	count += atomic.LoadUint64(&m.fanoutCounts[len(fanoutBuckets)])
+	fmt.Fprintf(w, "lim_fanout_duration_seconds_bucket{le=\"+Inf\"} %d\n", count)
+	fmt.Fprintf(w, "lim_fanout_duration_seconds_sum %g\n", time.Duration(atomic.LoadUint64(&m.fanoutSum)).Seconds())
+	fmt.Fprintf(w, "lim_fanout_duration_seconds_count %d\n", count)
+}
+
+// labelValue the quoted label value
+func labelValue(v string) string {
+	return `"` + labelEscaper.Replace(v) + `"`
+}
+
+func header(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// writeDirections the samples of an action, the actions never seen are left out
+// and the ones without a name are labeled by their value
+func writeDirections(w io.Writer, name string, act protocol.Action, in, out *uint64) {
+	if i, o := atomic.LoadUint64(in), atomic.LoadUint64(out); i > 0 || o > 0 {
+		action := act.String()
+		if action == "unknown" {
+			action = strconv.Itoa(int(act))
+		}
+		fmt.Fprintf(w, "%s{direction=\"in\",action=%s} %d\n", name, labelValue(action), i)
+		fmt.Fprintf(w, "%s{direction=\"out\",action=%s} %d\n", name, labelValue(action), o)
+	}
+}
@@ -0,0 +1,48 @@
+package internal
+
+import (
+	"crypto/rand"
+	"sync"
+	"time"
+)
+
+// nonceCache every issued nonce can be consumed only once before it expires
+type nonceCache struct {
+	nonces map[string]time.Time
+	sweep  time.Time
+	mu     sync.Mutex
+}
+
+func newNonceCache() *nonceCache {
+	return &nonceCache{nonces: make(map[string]time.Time)}
+}
+
+func (c *nonceCache) issue() ([]byte, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if now.After(c.sweep) {
+		for n, expiry := range c.nonces {
+			if now.After(expiry) {
+				delete(c.nonces, n)
+			}
+		}
+		c.sweep = now.Add(ChallengeSkew)
+	}
+	c.nonces[string(nonce)] = now.Add(ChallengeSkew)
+	return nonce, nil
+}
+
+func (c *nonceCache) consume(nonce []byte) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	expiry, ok := c.nonces[string(nonce)]
+	if ok {
+		delete(c.nonces, string(nonce))
+	}
+	return ok && time.Now().Before(expiry)
+}
@@ -0,0 +1,99 @@
+package internal
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFanoutOrder(t *testing.T) {
+	const publishers, subscribers, messages = 4, 3, 200
+	labels := []string{"order.a", "order.b"}
+
+	server := NewServer()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	go server.ListenAndServe(addr)
+	node := &node{server: server, addr: addr}
+	defer node.stop()
+
+	received := make(chan error, subscribers)
+	for i := 0; i < subscribers; i++ {
+		client := node.client(t)
+		for _, label := range labels {
+			if err := client.Label(label); err != nil {
+				t.Fatal(err)
+			}
+		}
+		go func() {
+			received <- checkOrder(client, labels, publishers, messages)
+		}()
+	}
+
+	var published sync.WaitGroup
+	for i := 0; i < publishers; i++ {
+		client := node.client(t)
+		published.Add(1)
+		go func(publisher int) {
+			defer published.Done()
+			for n := 0; n < messages; n++ {
+				for _, label := range labels {
+					data := binary.BigEndian.AppendUint32([]byte{byte(publisher)}, uint32(n))
+					if err := client.Multicast(label, data); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}
+		}(i)
+	}
+	published.Wait()
+
+	for i := 0; i < subscribers; i++ {
+		select {
+		case err := <-received:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("timed out receiving")
+		}
+	}
+}
+
+// checkOrder receive every message of the publishers and fail on the first one that does not
+// follow the previous one from the same publisher to the same label, or the label sequence
+func checkOrder(client *Client, labels []string, publishers, messages int) error {
+	next := make(map[string][]uint32)
+	seqs := make(map[string]uint64)
+	for _, label := range labels {
+		next[label] = make([]uint32, publishers)
+	}
+	for total := 0; total < len(labels)*publishers*messages; total++ {
+		msg, err := client.ReceiveMessage()
+		if err != nil {
+			return err
+		}
+		label, data := msg.Label, msg.Data
+		if msg.Seq != seqs[label]+1 {
+			return fmt.Errorf("sequence %d on %s arrived after %d", msg.Seq, label, seqs[label])
+		}
+		seqs[label] = msg.Seq
+		if len(data) != 1 || len(data[0]) != 5 {
+			return fmt.Errorf("unexpected data %q on %s", data, label)
+		}
+		publisher, n := data[0][0], binary.BigEndian.Uint32(data[0][1:])
+		if expected := next[label][publisher]; n != expected {
+			return fmt.Errorf("message %d of publisher %d on %s arrived when %d was expected", n, publisher, label, expected)
+		}
+		next[label][publisher]++
+	}
+	return nil
+}
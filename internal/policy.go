@@ -0,0 +1,147 @@
+package internal
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/NanoRed/lim/internal/protocol"
+)
+
+// Right what a connection may do with a label
+type Right uint8
+
+const (
+	RightSubscribe Right = 1 << iota
+	RightPublish
+)
+
+func (r Right) String() string {
+	switch r {
+	case RightSubscribe:
+		return "subscribe to"
+	case RightPublish:
+		return "publish to"
+	}
+	return "access"
+}
+
+var globEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`)
+
+type policyRule struct {
+	allow   bool
+	rights  Right
+	subject string // *, an identity ID, or key=value of the identity attributes
+	pattern string // glob of the labels, {id} is replaced by the identity ID
+}
+
+func (r *policyRule) match(identity *Identity, right Right, label string) bool {
+	if r.rights&right == 0 {
+		return false
+	}
+	if r.subject != "*" {
+		if k, v, ok := strings.Cut(r.subject, "="); ok {
+			if identity.Attrs[k] != v {
+				return false
+			}
+		} else if r.subject != identity.ID {
+			return false
+		}
+	}
+	matched, _ := path.Match(strings.ReplaceAll(r.pattern, "{id}", globEscaper.Replace(identity.ID)), label)
+	return matched
+}
+
+// Policy the label access rules loaded from a file, the first matching rule decides and
+// nothing is allowed without one.
+// line: allow|deny sub|pub|all subject label, lines led by # are ignored, for example
+//
+//	allow sub * public.*
+//	allow all * user.{id}
+//	allow pub role=admin *
+type Policy struct {
+	path  string
+	rules []*policyRule
+	rwmu  sync.RWMutex
+}
+
+func NewPolicy(path string) (*Policy, error) {
+	p := &Policy{path: path}
+	if err := p.Reload(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Reload read the policy file again, the old rules are kept on error
+func (p *Policy) Reload() error {
+	f, err := os.Open(p.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var rules []*policyRule
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 4 {
+			return errors.New("malformed policy file at line " + strconv.Itoa(n))
+		}
+		rule := &policyRule{subject: fields[2], pattern: fields[3]}
+		switch fields[0] {
+		case "allow":
+			rule.allow = true
+		case "deny":
+		default:
+			return errors.New("unknown policy effect at line " + strconv.Itoa(n))
+		}
+		switch fields[1] {
+		case "sub":
+			rule.rights = RightSubscribe
+		case "pub":
+			rule.rights = RightPublish
+		case "all":
+			rule.rights = RightSubscribe | RightPublish
+		default:
+			return errors.New("unknown policy right at line " + strconv.Itoa(n))
+		}
+		if _, err := path.Match(rule.pattern, ""); err != nil {
+			return errors.New("malformed label pattern at line " + strconv.Itoa(n))
+		}
+		rules = append(rules, rule)
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+	p.rwmu.Lock()
+	p.rules = rules
+	p.rwmu.Unlock()
+	return nil
+}
+
+func (p *Policy) Allow(identity *Identity, right Right, label string) bool {
+	p.rwmu.RLock()
+	defer p.rwmu.RUnlock()
+	for _, rule := range p.rules {
+		if rule.match(identity, right, label) {
+			return rule.allow
+		}
+	}
+	return false
+}
+
+// authorize the forbidden error of the right on the label, nil if it is allowed
+func (p *Policy) authorize(identity *Identity, right Right, label string) error {
+	if p == nil || p.Allow(identity, right, label) {
+		return nil
+	}
+	return &protocol.Error{Code: protocol.CodeForbidden, Message: "not allowed to " + right.String() + " " + label}
+}
@@ -7,4 +7,48 @@ const (
 	ActHandshake
 	ActLabel
 	ActMulticast
+	ActUnicast // v2, the label is the target, or the sender when it arrives
+	ActAck     // v2, the payload is the last sequence of the label consumed by the client
+	ActClose   // v2, the sender is closing the connection, the payload is the reason
 )
+
+var actionNames = []string{"response", "handshake", "label", "multicast", "unicast", "ack", "close"}
+
+func (a Action) String() string {
+	if int(a) < len(actionNames) {
+		return actionNames[a]
+	}
+	return "unknown"
+}
+
+// Flag frame options carried by the flags byte of protocol v2
+type Flag uint8
+
+// FlagNoEcho leaves the sender out of the fan-out of a multicast, set on a label
+// request it does so for every multicast of the connection to the label
+const FlagNoEcho Flag = 0x02
+
+// FlagAck asks the server to answer a multicast with a response once it is fanned out
+// (and appended to the journal), the response carries the error of a refused one
+const FlagAck Flag = 0x04
+
+type Version uint8
+
+const (
+	V1 Version = iota + 1 // 2 bits action, 12 bits payload size
+	V2                    // 1 byte action, 1 byte flags, extensions, varint payload size
+)
+
+// Versions supported versions, from the most preferred one
+var Versions = []Version{V2, V1}
+
+// Compressions supported compression algorithms, from the most preferred one
+var Compressions = []string{CompressFlate}
+
+// MaxPayload the largest payload a frame of the version can carry
+func (v Version) MaxPayload() int {
+	if v == V1 {
+		return 4095
+	}
+	return 1 << 24
+}
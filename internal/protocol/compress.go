@@ -0,0 +1,60 @@
+package protocol
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"sync"
+)
+
+// FlagCompressed the payload is compressed with the negotiated algorithm
+const FlagCompressed Flag = 0x01
+
+const CompressFlate = "flate"
+
+var _flateWriterPool = &sync.Pool{New: func() any {
+	w, _ := flate.NewWriter(nil, flate.BestSpeed)
+	return w
+}}
+
+func compress(algorithm string, payload []byte) ([]byte, error) {
+	if algorithm != CompressFlate {
+		return nil, errors.New("unsupported compression algorithm")
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, len(payload)/2))
+	w := _flateWriterPool.Get().(*flate.Writer)
+	defer _flateWriterPool.Put(w)
+	w.Reset(buf)
+	if _, err := w.Write(payload); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decompress restore the payload of a compressed frame in place,
+// payloads inflating to more than max bytes are refused
+func Decompress(algorithm string, frame *Frame, max int) error {
+	if frame.Flags&FlagCompressed == 0 {
+		return nil
+	}
+	if algorithm != CompressFlate {
+		return errors.New("unsupported compression algorithm")
+	}
+	r := flate.NewReader(bytes.NewReader(frame.Payload))
+	defer r.Close()
+	buf := bytes.NewBuffer(make([]byte, 0, len(frame.Payload)*4))
+	n, err := io.Copy(buf, io.LimitReader(r, int64(max)+1))
+	if err != nil {
+		return err
+	}
+	if n > int64(max) {
+		return errors.New("decompressed payload is more than the limit")
+	}
+	frame.Payload = buf.Bytes()
+	frame.Flags &^= FlagCompressed
+	return nil
+}
@@ -0,0 +1,59 @@
+package protocol
+
+import (
+	"strings"
+)
+
+// codes of the typed response errors
+const (
+	CodeDenied      = "denied"      // rejected by a server hook
+	CodeForbidden   = "forbidden"   // not allowed by the label policy
+	CodeUndelivered = "undelivered" // some of the receivers can not take the message
+)
+
+var (
+	ErrDenied      = &Error{Code: CodeDenied}
+	ErrForbidden   = &Error{Code: CodeForbidden}
+	ErrUndelivered = &Error{Code: CodeUndelivered}
+)
+
+// Error the error of a response, a typed one is sent as "[code] message"
+// so that the clients unaware of the codes still get a readable message
+type Error struct {
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	if len(e.Code) == 0 {
+		return e.Message
+	}
+	return e.Code + ": " + e.Message
+}
+
+// Is match any error of the same code, errors.Is(err, ErrForbidden) for example
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && len(t.Code) > 0 && t.Code == e.Code
+}
+
+func (e *Error) Marshal() []byte {
+	if len(e.Code) == 0 {
+		return []byte(e.Message)
+	}
+	return []byte("[" + e.Code + "] " + e.Message)
+}
+
+// ResponseError a response payload is either empty, structured data or an error message
+func ResponseError(payload []byte) error {
+	if len(payload) == 0 || payload[0] == dataMarker {
+		return nil
+	}
+	msg := string(payload)
+	if strings.HasPrefix(msg, "[") {
+		if code, message, ok := strings.Cut(msg[1:], "] "); ok {
+			return &Error{Code: code, Message: message}
+		}
+	}
+	return &Error{Message: msg}
+}
@@ -0,0 +1,40 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// extensions stamped by the server on the delivered frames
+const (
+	ExtSequence   uint8 = iota + 1 // per-label sequence number, uvarint
+	ExtTimestamp                   // server time in unix milliseconds, uvarint
+	ExtSenderConn                  // connection ID of the sender, uvarint
+	ExtSenderUser                  // identity ID of the sender
+	ExtMessageID                   // ID given by the publisher, kept by the server so that the receivers can dedupe
+)
+
+func (f *Frame) SetUvarint(typ uint8, v uint64) {
+	f.SetExtension(typ, binary.AppendUvarint(nil, v))
+}
+
+func (f *Frame) Uvarint(typ uint8) (uint64, bool) {
+	if value, ok := f.Extension(typ); ok {
+		if v, n := binary.Uvarint(value); n > 0 {
+			return v, true
+		}
+	}
+	return 0, false
+}
+
+// Stamp tag the frame with the delivery metadata
+func (f *Frame) Stamp(seq uint64, now time.Time, connID uint64, userID string) {
+	if seq > 0 {
+		f.SetUvarint(ExtSequence, seq)
+	}
+	f.SetUvarint(ExtTimestamp, uint64(now.UnixMilli()))
+	f.SetUvarint(ExtSenderConn, connID)
+	if len(userID) > 0 && len(userID) <= maxExtensionValue {
+		f.SetExtension(ExtSenderUser, []byte(userID))
+	}
+}
@@ -13,9 +13,31 @@ var _framePool = &sync.Pool{New: func() any {
 	return &Frame{}
 }}
 
+// v2 flags byte, the higher 3 bits describe the layout of the frame,
+// the lower 5 bits are the options of the frame (see Flag)
+const (
+	flagPayload   byte = 0x80
+	flagLabel     byte = 0x40
+	flagExtension byte = 0x20
+	flagMask      Flag = 0x1f
+)
+
+const (
+	maxExtensions     = 16
+	maxExtensionValue = 255
+)
+
+// Extension optional typed field of a v2 frame
+type Extension struct {
+	Type  uint8
+	Value []byte
+}
+
 type Frame struct {
 	Act     Action
+	Flags   Flag
 	Label   string
+	Ext     []Extension
 	Payload []byte
 }
 
@@ -25,11 +47,115 @@ func NewFrame() *Frame {
 
 func (f *Frame) Recycle() {
 	f.Act = 0
+	f.Flags = 0
 	f.Label = ""
+	f.Ext = nil
 	f.Payload = nil
 	_framePool.Put(f)
 }
 
+func (f *Frame) Extension(typ uint8) ([]byte, bool) {
+	for _, ext := range f.Ext {
+		if ext.Type == typ {
+			return ext.Value, true
+		}
+	}
+	return nil, false
+}
+
+func (f *Frame) SetExtension(typ uint8, value []byte) {
+	for i := range f.Ext {
+		if f.Ext[i].Type == typ {
+			f.Ext[i].Value = value
+			return
+		}
+	}
+	f.Ext = append(f.Ext, Extension{typ, value})
+}
+
+// Marshal encode the frame into bytes with the layout of the specific version
+func Marshal(version Version, frame *Frame) ([]byte, error) {
+	switch version {
+	case V1:
+		return marshalV1(frame)
+	case V2:
+		return marshalV2(frame)
+	}
+	return nil, errors.New("unsupported protocol version")
+}
+
+// v1: the extensions of the frame are not representable and will be dropped
+func marshalV1(frame *Frame) ([]byte, error) {
+	if frame.Act > ActMulticast {
+		return nil, errors.New("action is not supported by protocol v1")
+	}
+	if frame.Flags != 0 {
+		return nil, errors.New("flags are not supported by protocol v1")
+	}
+	data := []byte{0}
+	if dlen := len(frame.Payload); dlen > 0 {
+		if dlen > 4095 {
+			return nil, errors.New("payload is more than 4095 bytes")
+		}
+		data = make([]byte, dlen+2)
+		binary.BigEndian.PutUint16(data, uint16(dlen))
+		data[0] |= 0x20
+		copy(data[2:], frame.Payload)
+	}
+	data[0] |= byte(frame.Act) << 6
+	if llen := len(frame.Label); llen > 0 {
+		if llen > 255 {
+			return nil, errors.New("label is more than 255 bytes")
+		}
+		data = append(data, byte(llen))
+		data = append(data, frame.Label...)
+		data[0] |= 0x10
+	}
+	return data, nil
+}
+
+// v2: | action 1B | flags 1B | [extensions] | [label] | [payload] |
+// extensions: count 1B, then type 1B, size 1B, value for each one
+// label: size 1B, label
+// payload: size uvarint, payload
+func marshalV2(frame *Frame) ([]byte, error) {
+	dlen, llen := len(frame.Payload), len(frame.Label)
+	if dlen > V2.MaxPayload() {
+		return nil, errors.New("payload is more than the limit of protocol v2")
+	}
+	if llen > 255 {
+		return nil, errors.New("label is more than 255 bytes")
+	}
+	if len(frame.Ext) > maxExtensions {
+		return nil, errors.New("too many extensions")
+	}
+	data := make([]byte, 2, 2+dlen+llen+16)
+	data[0] = byte(frame.Act)
+	data[1] = byte(frame.Flags & flagMask)
+	if len(frame.Ext) > 0 {
+		data[1] |= flagExtension
+		data = append(data, byte(len(frame.Ext)))
+		for _, ext := range frame.Ext {
+			if len(ext.Value) > maxExtensionValue {
+				return nil, errors.New("extension value is more than 255 bytes")
+			}
+			data = append(data, ext.Type, byte(len(ext.Value)))
+			data = append(data, ext.Value...)
+		}
+	}
+	if llen > 0 {
+		data[1] |= flagLabel
+		data = append(data, byte(llen))
+		data = append(data, frame.Label...)
+	}
+	if dlen > 0 {
+		data[1] |= flagPayload
+		data = binary.AppendUvarint(data, uint64(dlen))
+		data = append(data, frame.Payload...)
+	}
+	return data, nil
+}
+
 type FrameProcessor struct {
 	*FrameEncoder
 	*FrameDecoder
@@ -39,6 +165,11 @@ func NewFrameProcessor(rw io.ReadWriter) *FrameProcessor {
 	return &FrameProcessor{NewFrameEncoder(rw), NewFrameDecoder(rw)}
 }
 
+func (p *FrameProcessor) SetVersion(version Version) {
+	p.FrameEncoder.SetVersion(version)
+	p.FrameDecoder.SetVersion(version)
+}
+
 func (p *FrameProcessor) SetDecodeTimeout(t time.Duration) error {
 	if conn, ok := p.w.(net.Conn); ok {
 		if t > 0 {
@@ -51,32 +182,43 @@ func (p *FrameProcessor) SetDecodeTimeout(t time.Duration) error {
 }
 
 type FrameEncoder struct {
-	w io.Writer
+	w           io.Writer
+	version     Version
+	compression string
+	threshold   int
 }
 
 func NewFrameEncoder(w io.Writer) *FrameEncoder {
-	return &FrameEncoder{w}
+	return &FrameEncoder{w: w, version: V1}
+}
+
+// SetCompression compress the payloads of at least threshold bytes,
+// an empty algorithm turns the compression off
+func (e *FrameEncoder) SetCompression(algorithm string, threshold int) {
+	e.compression = algorithm
+	e.threshold = threshold
+}
+
+func (e *FrameEncoder) SetVersion(version Version) {
+	e.version = version
+}
+
+func (e *FrameEncoder) Version() Version {
+	return e.version
 }
 
 func (e *FrameEncoder) Encode(frame *Frame) (err error) {
-	data := []byte{0}
-	if dlen := len(frame.Payload); dlen > 0 {
-		if dlen > 4095 {
-			return errors.New("payload is more than 4095 bytes")
+	if len(e.compression) > 0 && frame.Flags&FlagCompressed == 0 && len(frame.Payload) >= e.threshold {
+		if payload, err := compress(e.compression, frame.Payload); err == nil && len(payload) < len(frame.Payload) {
+			compressed := *frame
+			compressed.Flags |= FlagCompressed
+			compressed.Payload = payload
+			frame = &compressed
 		}
-		data = make([]byte, dlen+2)
-		binary.BigEndian.PutUint16(data, uint16(dlen))
-		data[0] |= 0x20
-		copy(data[2:], frame.Payload)
 	}
-	data[0] |= byte(frame.Act) << 6
-	if llen := len(frame.Label); llen > 0 {
-		if llen > 255 {
-			return errors.New("label is more than 255 bytes")
-		}
-		data = append(data, byte(llen))
-		data = append(data, frame.Label...)
-		data[0] |= 0x10
+	data, err := Marshal(e.version, frame)
+	if err != nil {
+		return
 	}
 	_, err = e.w.Write(data)
 	return
@@ -90,14 +232,46 @@ func (e *FrameEncoder) Close() (err error) {
 }
 
 type FrameDecoder struct {
-	r io.Reader
+	r          io.Reader
+	version    Version
+	maxPayload int
 }
 
 func NewFrameDecoder(r io.Reader) *FrameDecoder {
-	return &FrameDecoder{r}
+	return &FrameDecoder{r, V1, V1.MaxPayload()}
+}
+
+func (d *FrameDecoder) SetVersion(version Version) {
+	d.version = version
+	d.maxPayload = version.MaxPayload()
+}
+
+// SetMaxPayload frames carrying a larger payload are refused instead of buffered
+func (d *FrameDecoder) SetMaxPayload(size int) {
+	if size > 0 && size < d.version.MaxPayload() {
+		d.maxPayload = size
+	}
+}
+
+func (d *FrameDecoder) Version() Version {
+	return d.version
 }
 
 func (d *FrameDecoder) Decode(frame *Frame) (raw []byte, err error) {
+	frame.Flags = 0
+	frame.Label = ""
+	frame.Ext = nil
+	frame.Payload = nil
+	switch d.version {
+	case V1:
+		return d.decodeV1(frame)
+	case V2:
+		return d.decodeV2(frame)
+	}
+	return nil, errors.New("unsupported protocol version")
+}
+
+func (d *FrameDecoder) decodeV1(frame *Frame) (raw []byte, err error) {
 	raw = make([]byte, 1, 2)
 	if _, err = io.ReadFull(d.r, raw); err != nil {
 		return
@@ -132,3 +306,88 @@ func (d *FrameDecoder) Decode(frame *Frame) (raw []byte, err error) {
 	}
 	return
 }
+
+func (d *FrameDecoder) decodeV2(frame *Frame) (raw []byte, err error) {
+	raw = make([]byte, 2, 16)
+	if _, err = io.ReadFull(d.r, raw); err != nil {
+		return
+	}
+	frame.Act = Action(raw[0])
+	frame.Flags = Flag(raw[1]) & flagMask
+	if raw[1]&flagExtension > 0 {
+		if raw, err = d.read(raw, 1); err != nil {
+			return
+		}
+		count := int(raw[len(raw)-1])
+		if count > maxExtensions {
+			err = errors.New("too many extensions")
+			return
+		}
+		frame.Ext = make([]Extension, count)
+		for i := range frame.Ext {
+			if raw, err = d.read(raw, 2); err != nil {
+				return
+			}
+			frame.Ext[i].Type = raw[len(raw)-2]
+			p := len(raw)
+			if raw, err = d.read(raw, int(raw[len(raw)-1])); err != nil {
+				return
+			}
+			frame.Ext[i].Value = raw[p:len(raw):len(raw)]
+		}
+	}
+	if raw[1]&flagLabel > 0 {
+		if raw, err = d.read(raw, 1); err != nil {
+			return
+		}
+		p := len(raw)
+		if raw, err = d.read(raw, int(raw[p-1])); err != nil {
+			return
+		}
+		frame.Label = string(raw[p:])
+	}
+	if raw[1]&flagPayload > 0 {
+		var size uint64
+		if raw, size, err = d.readUvarint(raw); err != nil {
+			return
+		}
+		if size > uint64(d.maxPayload) {
+			err = errors.New("payload is more than the negotiated limit")
+			return
+		}
+		p := len(raw)
+		if raw, err = d.read(raw, int(size)); err != nil {
+			return
+		}
+		frame.Payload = raw[p:]
+	}
+	return
+}
+
+func (d *FrameDecoder) readUvarint(raw []byte) ([]byte, uint64, error) {
+	p := len(raw)
+	for i := 0; i < binary.MaxVarintLen64; i++ {
+		var err error
+		if raw, err = d.read(raw, 1); err != nil {
+			return raw, 0, err
+		}
+		if raw[len(raw)-1] < 0x80 {
+			v, _ := binary.Uvarint(raw[p:])
+			return raw, v, nil
+		}
+	}
+	return raw, 0, errors.New("malformed varint")
+}
+
+// read append the next n bytes of the stream to raw
+func (d *FrameDecoder) read(raw []byte, n int) ([]byte, error) {
+	p := len(raw)
+	if cap(raw)-p < n {
+		tmp := make([]byte, p, 2*cap(raw)+n)
+		copy(tmp, raw)
+		raw = tmp
+	}
+	raw = raw[:p+n]
+	_, err := io.ReadFull(d.r, raw[p:])
+	return raw, err
+}
@@ -0,0 +1,366 @@
+package protocol
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// dataMarker leads the structured payloads of the handshake and response frames,
+// the legacy handshake payload is the plain secret and a non-empty legacy
+// response payload is an error message, neither of them starts with it
+const dataMarker byte = 0x00
+
+// handshake fields
+const (
+	hsVersions uint8 = iota + 1
+	hsSecret
+	hsVersion
+	hsCompression
+	hsMaxPayload
+	hsHeartbeat
+	hsID
+	hsChallenge
+	hsNonce
+	hsTime
+	hsMAC
+	hsConnID
+	hsSession
+	hsReceived
+	hsResumed
+	hsSalt
+)
+
+// Hello the handshake payload sent by the client,
+// the features are the ones the client supports or prefers,
+// a client accepting a challenge leaves the secret out of it
+type Hello struct {
+	Versions     []Version
+	Compressions []string
+	MaxPayload   uint32
+	Heartbeat    time.Duration
+	ID           string
+	Secret       []byte
+	Challenge    bool
+	Legacy       bool
+	Session      string // the token of the session to resume
+	Received     uint64 // the relayed frames received in the session
+}
+
+func (h *Hello) Marshal() []byte {
+	data := []byte{dataMarker}
+	versions := make([]byte, len(h.Versions))
+	for i, v := range h.Versions {
+		versions[i] = byte(v)
+	}
+	data = appendField(data, hsVersions, versions)
+	if len(h.Compressions) > 0 {
+		data = appendField(data, hsCompression, []byte(strings.Join(h.Compressions, ",")))
+	}
+	if h.MaxPayload > 0 {
+		data = appendField(data, hsMaxPayload, binary.AppendUvarint(nil, uint64(h.MaxPayload)))
+	}
+	if h.Heartbeat > 0 {
+		data = appendField(data, hsHeartbeat, binary.AppendUvarint(nil, uint64(h.Heartbeat.Milliseconds())))
+	}
+	if len(h.ID) > 0 {
+		data = appendField(data, hsID, []byte(h.ID))
+	}
+	if len(h.Session) > 0 {
+		data = appendField(data, hsSession, []byte(h.Session))
+		data = appendField(data, hsReceived, binary.AppendUvarint(nil, h.Received))
+	}
+	if h.Challenge {
+		data = appendField(data, hsChallenge, nil)
+	} else {
+		data = appendField(data, hsSecret, h.Secret)
+	}
+	return data
+}
+
+func UnmarshalHello(payload []byte) (*Hello, error) {
+	if len(payload) == 0 || payload[0] != dataMarker {
+		return &Hello{Versions: []Version{V1}, Secret: payload, Legacy: true}, nil
+	}
+	hello := &Hello{}
+	err := rangeFields(payload[1:], func(typ uint8, value []byte) {
+		switch typ {
+		case hsVersions:
+			hello.Versions = make([]Version, len(value))
+			for i, v := range value {
+				hello.Versions[i] = Version(v)
+			}
+		case hsCompression:
+			if len(value) > 0 {
+				hello.Compressions = strings.Split(string(value), ",")
+			}
+		case hsMaxPayload:
+			if size, n := binary.Uvarint(value); n > 0 {
+				hello.MaxPayload = uint32(size)
+			}
+		case hsHeartbeat:
+			if ms, n := binary.Uvarint(value); n > 0 {
+				hello.Heartbeat = time.Duration(ms) * time.Millisecond
+			}
+		case hsID:
+			hello.ID = string(value)
+		case hsSecret:
+			hello.Secret = value
+		case hsChallenge:
+			hello.Challenge = true
+		case hsSession:
+			hello.Session = string(value)
+		case hsReceived:
+			if received, n := binary.Uvarint(value); n > 0 {
+				hello.Received = received
+			}
+		}
+	})
+	return hello, err
+}
+
+// Challenge sent by the server in answer to a hello accepting it,
+// without a nonce the client is asked to send its secret as the proof,
+// with a salt the client proves the salted key of its secret (see SaltedKey)
+type Challenge struct {
+	Nonce []byte
+	Salt  []byte
+}
+
+func (c *Challenge) Marshal() []byte {
+	data := []byte{dataMarker}
+	if len(c.Nonce) > 0 {
+		data = appendField(data, hsNonce, c.Nonce)
+	}
+	if len(c.Salt) > 0 {
+		data = appendField(data, hsSalt, c.Salt)
+	}
+	return data
+}
+
+func UnmarshalChallenge(payload []byte) (*Challenge, error) {
+	if len(payload) == 0 || payload[0] != dataMarker {
+		return nil, errors.New("malformed challenge")
+	}
+	challenge := &Challenge{}
+	err := rangeFields(payload[1:], func(typ uint8, value []byte) {
+		switch typ {
+		case hsNonce:
+			challenge.Nonce = value
+		case hsSalt:
+			challenge.Salt = value
+		}
+	})
+	return challenge, err
+}
+
+// Proof the answer of the client to a challenge
+type Proof struct {
+	Time   time.Time
+	MAC    []byte
+	Secret []byte
+}
+
+// ChallengeKey the key proving the possession of a secret
+func ChallengeKey(secret []byte) []byte {
+	key := sha256.Sum256(secret)
+	return key[:]
+}
+
+// Sign mac: hmac-sha256(key, nonce | id | unix milliseconds)
+func (p *Proof) Sign(key, nonce []byte, id string) {
+	p.MAC = p.sum(key, nonce, id)
+}
+
+func (p *Proof) Verify(key, nonce []byte, id string) bool {
+	return hmac.Equal(p.MAC, p.sum(key, nonce, id))
+}
+
+// SaltedKey the client key of a secret under the salt: hmac-sha256(scrypt(secret, salt), "client key"),
+// the server keeps only StoredKey of it, which does not sign a proof
+func SaltedKey(secret, salt []byte) ([]byte, error) {
+	derived, err := scrypt.Key(secret, salt, 1<<15, 8, 1, sha256.Size)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, derived)
+	mac.Write([]byte("client key"))
+	return mac.Sum(nil), nil
+}
+
+// StoredKey the digest of a salted key that the server verifies a proof with
+func StoredKey(saltedKey []byte) []byte {
+	key := sha256.Sum256(saltedKey)
+	return key[:]
+}
+
+// SignSalted mac: saltedKey xor hmac-sha256(StoredKey(saltedKey), nonce | id | unix milliseconds)
+func (p *Proof) SignSalted(saltedKey, nonce []byte, id string) {
+	p.MAC = p.sum(StoredKey(saltedKey), nonce, id)
+	for i := range p.MAC {
+		p.MAC[i] ^= saltedKey[i]
+	}
+}
+
+// VerifySalted recover the salted key from the mac and check it against the stored key
+func (p *Proof) VerifySalted(storedKey, nonce []byte, id string) bool {
+	if len(p.MAC) != sha256.Size {
+		return false
+	}
+	saltedKey := p.sum(storedKey, nonce, id)
+	for i := range saltedKey {
+		saltedKey[i] ^= p.MAC[i]
+	}
+	return hmac.Equal(StoredKey(saltedKey), storedKey)
+}
+
+func (p *Proof) sum(key, nonce []byte, id string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(nonce)
+	mac.Write([]byte(id))
+	mac.Write(binary.BigEndian.AppendUint64(nil, uint64(p.Time.UnixMilli())))
+	return mac.Sum(nil)
+}
+
+func (p *Proof) Marshal() []byte {
+	data := []byte{dataMarker}
+	if len(p.MAC) > 0 {
+		data = appendField(data, hsTime, binary.AppendUvarint(nil, uint64(p.Time.UnixMilli())))
+		data = appendField(data, hsMAC, p.MAC)
+	} else {
+		data = appendField(data, hsSecret, p.Secret)
+	}
+	return data
+}
+
+func UnmarshalProof(payload []byte) (*Proof, error) {
+	if len(payload) == 0 || payload[0] != dataMarker {
+		return nil, errors.New("malformed proof")
+	}
+	proof := &Proof{}
+	err := rangeFields(payload[1:], func(typ uint8, value []byte) {
+		switch typ {
+		case hsTime:
+			if ms, n := binary.Uvarint(value); n > 0 {
+				proof.Time = time.UnixMilli(int64(ms))
+			}
+		case hsMAC:
+			proof.MAC = value
+		case hsSecret:
+			proof.Secret = value
+		}
+	})
+	return proof, err
+}
+
+// Welcome the handshake result answered by the server,
+// the features are the ones chosen for the connection
+type Welcome struct {
+	Version     Version
+	Compression string
+	MaxPayload  uint32
+	Heartbeat   time.Duration
+	ConnID      uint64
+	Session     string // the token to resume the session with
+	Resumed     bool   // the session of the hello is resumed, with its labels
+}
+
+func (w *Welcome) Marshal() []byte {
+	data := []byte{dataMarker}
+	data = appendField(data, hsVersion, []byte{byte(w.Version)})
+	if len(w.Compression) > 0 {
+		data = appendField(data, hsCompression, []byte(w.Compression))
+	}
+	if w.MaxPayload > 0 {
+		data = appendField(data, hsMaxPayload, binary.AppendUvarint(nil, uint64(w.MaxPayload)))
+	}
+	if w.Heartbeat > 0 {
+		data = appendField(data, hsHeartbeat, binary.AppendUvarint(nil, uint64(w.Heartbeat.Milliseconds())))
+	}
+	if w.ConnID > 0 {
+		data = appendField(data, hsConnID, binary.AppendUvarint(nil, w.ConnID))
+	}
+	if len(w.Session) > 0 {
+		data = appendField(data, hsSession, []byte(w.Session))
+	}
+	if w.Resumed {
+		data = appendField(data, hsResumed, nil)
+	}
+	return data
+}
+
+// UnmarshalWelcome an empty payload is the answer of a legacy server,
+// the unset features should be treated as the v1 defaults by the caller
+func UnmarshalWelcome(payload []byte) (*Welcome, error) {
+	welcome := &Welcome{Version: V1}
+	if len(payload) == 0 {
+		return welcome, nil
+	}
+	if payload[0] != dataMarker {
+		return nil, errors.New("malformed welcome")
+	}
+	err := rangeFields(payload[1:], func(typ uint8, value []byte) {
+		switch typ {
+		case hsVersion:
+			if len(value) == 1 {
+				welcome.Version = Version(value[0])
+			}
+		case hsCompression:
+			welcome.Compression = string(value)
+		case hsMaxPayload:
+			if size, n := binary.Uvarint(value); n > 0 {
+				welcome.MaxPayload = uint32(size)
+			}
+		case hsHeartbeat:
+			if ms, n := binary.Uvarint(value); n > 0 {
+				welcome.Heartbeat = time.Duration(ms) * time.Millisecond
+			}
+		case hsConnID:
+			if id, n := binary.Uvarint(value); n > 0 {
+				welcome.ConnID = id
+			}
+		case hsSession:
+			welcome.Session = string(value)
+		case hsResumed:
+			welcome.Resumed = true
+		}
+	})
+	return welcome, err
+}
+
+// Negotiate pick the most preferred version supported by both sides
+func Negotiate(offered []Version) (Version, error) {
+	for _, v := range Versions {
+		for _, o := range offered {
+			if v == o {
+				return v, nil
+			}
+		}
+	}
+	return 0, errors.New("no supported protocol version")
+}
+
+func appendField(data []byte, typ uint8, value []byte) []byte {
+	data = append(data, typ)
+	data = binary.AppendUvarint(data, uint64(len(value)))
+	return append(data, value...)
+}
+
+func rangeFields(data []byte, f func(typ uint8, value []byte)) error {
+	for len(data) > 0 {
+		typ := data[0]
+		size, n := binary.Uvarint(data[1:])
+		if n <= 0 || uint64(len(data)-1-n) < size {
+			return errors.New("malformed handshake field")
+		}
+		data = data[1+n:]
+		f(typ, data[:size])
+		data = data[size:]
+	}
+	return nil
+}
@@ -1,7 +1,11 @@
 package protocol
 
 import (
+	"crypto/rand"
 	"encoding/binary"
+	"errors"
+	"math"
+	"sync/atomic"
 	"time"
 	"unsafe"
 )
@@ -20,26 +24,46 @@ type stream struct {
 }
 
 type Packer struct {
-	blockBuf  map[[10]byte]*buffer
-	streamBuf map[string]*stream
-	readFrame func() *Frame
+	blockBuf   map[[10]byte]*buffer
+	streamBuf  map[string]*stream
+	readFrame  func() *Frame
+	maxPayload int32
 }
 
 func NewPacker(readFrame func() *Frame) *Packer {
 	particle := &Packer{
-		blockBuf:  make(map[[10]byte]*buffer),
-		streamBuf: make(map[string]*stream),
-		readFrame: readFrame,
+		blockBuf:   make(map[[10]byte]*buffer),
+		streamBuf:  make(map[string]*stream),
+		readFrame:  readFrame,
+		maxPayload: int32(V1.MaxPayload()),
 	}
 	return particle
 }
 
+// SetMaxPayload data is separated as pieces only when it does not fit in one frame
+func (p *Packer) SetMaxPayload(size int) {
+	if size < 64 {
+		size = V1.MaxPayload()
+	}
+	atomic.StoreInt32(&p.maxPayload, int32(size))
+}
+
 func (p *Packer) Assemble() (label string, data [][]byte) {
+	header, data := p.AssembleHeader()
+	return header.Label, data
+}
+
+// AssembleHeader the header is the frame completing the data without its payload,
+// a nil frame read ends it with no data
+func (p *Packer) AssembleHeader() (header Frame, data [][]byte) {
 	// 0x04 is it a stream frame
 	// 0x02 is it separated as pieces
 	// 0x01 0 means it is the last piece, 1 means the other pieces
 	for {
 		frame := p.readFrame()
+		if frame == nil {
+			return
+		}
 		if frame.Payload[0]&0x04 > 0 {
 			s, ok := p.streamBuf[frame.Label]
 			if !ok {
@@ -75,7 +99,7 @@ func (p *Packer) Assemble() (label string, data [][]byte) {
 						for k := uint16(0); k < b.max; k++ {
 							payload = append(payload, b.buf[k]...)
 						}
-						label = frame.Label
+						header, header.Payload = *frame, nil
 						data = append(data, payload)
 						i++
 						s.cursor = &i
@@ -86,7 +110,7 @@ func (p *Packer) Assemble() (label string, data [][]byte) {
 					goto NEXT
 				}
 			} else if s.cursor == nil {
-				label = frame.Label
+				header, header.Payload = *frame, nil
 				data = append(data, frame.Payload[11:])
 				i++
 				s.cursor = &i
@@ -115,7 +139,7 @@ func (p *Packer) Assemble() (label string, data [][]byte) {
 				*s.cursor++
 				goto NEXT
 			} else if data != nil {
-				label = frame.Label
+				header, header.Payload = *frame, nil
 				frame.Recycle()
 				return
 			} else if s.len > 20 {
@@ -156,14 +180,14 @@ func (p *Packer) Assemble() (label string, data [][]byte) {
 				for k := uint16(0); k < b.max; k++ {
 					payload = append(payload, b.buf[k]...)
 				}
-				label = frame.Label
+				header, header.Payload = *frame, nil
 				data = append(data, payload)
 				frame.Recycle()
 				return
 			}
 			// TODO check ts and remove
 		} else {
-			label = frame.Label
+			header, header.Payload = *frame, nil
 			data = append(data, frame.Payload[1:])
 			frame.Recycle()
 			return
@@ -173,11 +197,15 @@ func (p *Packer) Assemble() (label string, data [][]byte) {
 	}
 }
 
+// Pack the data too large for one frame is separated into pieces of the legacy frame size,
+// so that the server relays them to every connection as they are
 func (p *Packer) Pack(label string, data any) <-chan *Frame {
+	max := int(atomic.LoadInt32(&p.maxPayload))
+	piece := V1.MaxPayload() - 13
 	switch data := data.(type) {
 	case []byte:
 		if dlen := len(data); dlen > 0 {
-			if dlen < 4095 {
+			if dlen < max {
 				frame := NewFrame()
 				frame.Act = ActMulticast
 				frame.Label = label
@@ -192,13 +220,13 @@ func (p *Packer) Pack(label string, data any) <-chan *Frame {
 				var s uint64
 				now := uint64(time.Now().UnixNano())
 				rand := uint16(uintptr(unsafe.Pointer(&data)))
-				frames := make(chan *Frame, dlen/4082+1)
-				for ; dlen > 4082; dlen = dlen - 4082 {
-					e := s + 4082
+				frames := make(chan *Frame, dlen/piece+1)
+				for ; dlen > piece; dlen = dlen - piece {
+					e := s + uint64(piece)
 					frame := NewFrame()
 					frame.Act = ActMulticast
 					frame.Label = label
-					frame.Payload = make([]byte, 4095)
+					frame.Payload = make([]byte, 13+piece)
 					frame.Payload[0] = 0x03
 					binary.BigEndian.PutUint64(frame.Payload[1:], now)
 					binary.BigEndian.PutUint16(frame.Payload[9:], rand)
@@ -232,7 +260,7 @@ func (p *Packer) Pack(label string, data any) <-chan *Frame {
 					continue
 				}
 				now := uint64(time.Now().UnixNano())
-				if dlen <= 4084 {
+				if dlen <= max-11 {
 					frame := NewFrame()
 					frame.Act = ActMulticast
 					frame.Label = label
@@ -245,12 +273,12 @@ func (p *Packer) Pack(label string, data any) <-chan *Frame {
 				} else {
 					var j uint16
 					var s uint64
-					for ; dlen > 4082; dlen = dlen - 4082 {
-						e := s + 4082
+					for ; dlen > piece; dlen = dlen - piece {
+						e := s + uint64(piece)
 						frame := NewFrame()
 						frame.Act = ActMulticast
 						frame.Label = label
-						frame.Payload = make([]byte, 4095)
+						frame.Payload = make([]byte, 13+piece)
 						frame.Payload[0] = 0x07
 						binary.BigEndian.PutUint16(frame.Payload[1:], i)
 						binary.BigEndian.PutUint16(frame.Payload[3:], j)
@@ -281,3 +309,73 @@ func (p *Packer) Pack(label string, data any) <-chan *Frame {
 	close(frames)
 	return frames
 }
+
+// Split separate the data of the frame into pieces carrying at most max bytes of payload each,
+// the way Pack does. The data already separated by the sender can not be separated again
+func Split(frame *Frame, max int) ([]*Frame, error) {
+	payload := frame.Payload
+	if len(payload) <= max {
+		return []*Frame{frame}, nil
+	}
+	piece := max - 13
+	if piece <= 0 || payload[0]&0x02 > 0 {
+		return nil, errors.New("payload is too large for the connection")
+	}
+	var (
+		head  []byte // of every piece, but the flags and the piece index
+		data  []byte
+		index int // of the piece index in the head
+	)
+	if payload[0]&0x04 > 0 {
+		head, data, index = make([]byte, 13), payload[11:], 3
+		copy(head[1:3], payload[1:3])
+		copy(head[5:13], payload[3:11])
+	} else {
+		head, data, index = make([]byte, 13), payload[1:], 11
+		binary.BigEndian.PutUint64(head[1:], uint64(time.Now().UnixNano()))
+		if _, err := rand.Read(head[9:11]); err != nil {
+			return nil, err
+		}
+	}
+	if (len(data)+piece-1)/piece > math.MaxUint16 {
+		return nil, errors.New("payload has too many pieces for the connection")
+	}
+	pieces := make([]*Frame, 0, (len(data)+piece-1)/piece)
+	for i := 0; len(data) > 0; i++ {
+		n := piece
+		if n > len(data) {
+			n = len(data)
+		}
+		split := *frame
+		split.Payload = append(append(make([]byte, 0, 13+n), head...), data[:n]...)
+		split.Payload[0] = payload[0] | 0x02
+		if data = data[n:]; len(data) > 0 {
+			split.Payload[0] |= 0x01
+		}
+		binary.BigEndian.PutUint16(split.Payload[index:], uint16(i))
+		pieces = append(pieces, &split)
+	}
+	return pieces, nil
+}
+
+// Unpack separate the payload of a packed frame into the header of the packer and the data,
+// the data of a piece is only the part of it the piece carries
+func Unpack(payload []byte) (header, data []byte, err error) {
+	if len(payload) == 0 {
+		return nil, nil, errors.New("payload is not packed")
+	}
+	size := 1
+	switch payload[0] {
+	case 0x00:
+	case 0x04:
+		size = 11
+	case 0x02, 0x03, 0x06, 0x07:
+		size = 13
+	default:
+		return nil, nil, errors.New("payload is not packed")
+	}
+	if len(payload) < size {
+		return nil, nil, errors.New("payload is not packed")
+	}
+	return payload[:size:size], payload[size:], nil
+}
@@ -1,11 +1,15 @@
 package internal
 
 import (
-	"bytes"
+	"context"
+	"encoding/binary"
 	"errors"
+	"fmt"
 	"net"
 	"net/http"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/NanoRed/lim/internal/protocol"
@@ -14,95 +18,452 @@ import (
 	"github.com/NanoRed/lim/website"
 )
 
+var ErrServerClosed = errors.New("server closed")
+
+type shutdowner interface {
+	Shutdown(ctx context.Context) error
+}
+
 type Server struct {
+	auth        Authenticator
+	registry    Registry
+	hooks       hooks
+	policy      *Policy
+	queueSize   int
+	queuePolicy QueuePolicy
+	metrics     *metrics
+	sessions    *sessions
+	started     time.Time
+	bans        *sync.Map // identity ID to the reason
+	nonces      *nonceCache
+	clearSecret bool // the key authenticators accept the secrets in clear hellos
+	sequences   *sync.Map
+	history     *history
+	journal     *journal
+	cluster     *cluster
+	conns       *sync.Map
+	listeners   []net.Listener
+	servers     map[string]shutdowner
+	handlers    sync.WaitGroup // the read loops of the connections
+	done        chan struct{}
+	mu          sync.Mutex
 }
 
 func NewServer() *Server {
-	return &Server{}
+	return &Server{
+		registry:  NewRegistry(),
+		metrics:   newMetrics(),
+		started:   time.Now(),
+		bans:      &sync.Map{},
+		queueSize: SendQueueSize,
+		nonces:    newNonceCache(),
+		sequences: &sync.Map{},
+		conns:     &sync.Map{},
+		servers:   make(map[string]shutdowner),
+		done:      make(chan struct{}),
+	}
+}
+
+// SetAuthenticator verify the handshake of every connection with it,
+// connections are accepted anonymously without an authenticator
+func (s *Server) SetAuthenticator(auth Authenticator) {
+	s.auth = auth
+}
+
+// EnableClearSecrets let the key authenticators accept a secret in a clear hello as well, for the
+// clients from before the challenge-response handshake, anyone who captures such a hello can replay it
+func (s *Server) EnableClearSecrets() {
+	s.clearSecret = true
+}
+
+// SetRegistry replace the default registry of the connections, before serving,
+// the cluster enabled before watches the labels of the new one
+func (s *Server) SetRegistry(registry Registry) {
+	s.registry = registry
+	if s.cluster != nil {
+		registry.watch(s.cluster.changed)
+	}
+}
+
+// SetPolicy check the subscribe and publish rights of every connection with it,
+// everything is allowed without a policy
+func (s *Server) SetPolicy(policy *Policy) {
+	s.policy = policy
+}
+
+// SetSendQueue bound the relayed frames waiting for every connection, the policy
+// decides what happens to a connection too slow to keep up
+func (s *Server) SetSendQueue(size int, policy QueuePolicy) {
+	s.queueSize = size
+	s.queuePolicy = policy
+}
+
+// Use append hooks to the chain run by every connection, before serving
+func (s *Server) Use(hooks ...*Hook) {
+	s.hooks = append(s.hooks, hooks...)
+}
+
+// EnableHistory keep the last size messages not older than ttl of every label in memory,
+// so that a joining connection can ask for a replay (zero means no limit on that dimension)
+func (s *Server) EnableHistory(size int, ttl time.Duration) {
+	s.history = newHistory(size, ttl)
+}
+
+// EnableJournal append the messages of every label to segment logs under dir, removing
+// the oldest segments beyond maxBytes per label or maxAge (zero means no limit).
+// The logs are replayed into the label sequences and the history (enable it first),
+// and the authenticated identities receive what they missed since their last ack
+// when they label again
+func (s *Server) EnableJournal(dir string, maxBytes int64, maxAge time.Duration) (err error) {
+	if s.journal, err = openJournal(dir, maxBytes, maxAge); err != nil {
+		return
+	}
+	s.journal.recover(func(label string, last uint64) {
+		s.sequences.Store(label, &labelSequence{last: last})
+		if s.history == nil {
+			return
+		}
+		var since uint64 // only the records the history keeps are read
+		if s.history.size > 0 && last > uint64(s.history.size) {
+			since = last - uint64(s.history.size)
+		}
+		err := s.journal.since(label, since, func(rec *record) bool {
+			s.history.record(label, rec.seq, rec.fanout)
+			return true
+		})
+		if err != nil {
+			logger.Error("failed to recover the log of %s: %v", label, err)
+		}
+	})
+	return
+}
+
+// EnableCluster listen on addr for the peer nodes and keep links to the peers,
+// every node needs a unique name and the same secret, which must not be empty
+func (s *Server) EnableCluster(name, addr string, peers []string, secret []byte) error {
+	if len(secret) == 0 {
+		return errors.New("the cluster needs a secret")
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	s.cluster = newCluster(s, name, ln, secret)
+	s.registry.watch(s.cluster.changed)
+	go s.cluster.accept()
+	go s.cluster.announce()
+	for _, peer := range peers {
+		go s.cluster.dial(peer)
+	}
+	return nil
 }
 
 func (s *Server) EnableWSS(addr string, certFile, keyFile string) {
+	server := websocket.NewServer(func(c net.Conn) {
+		s.handle(newConn(c), TransportWSS)
+	})
+	if !s.serve("wss", server) {
+		return
+	}
 	go func() {
-		defer func() {
-			logger.Warn("restart websocket server in 1 seconds...")
-			time.Sleep(time.Second)
-			s.EnableWSS(addr, certFile, keyFile)
-		}()
-		if err := websocket.NewServer(func(c net.Conn) {
-			s.handle(&conn{Conn: c})
-		}).ListenAndServeTLS(addr, certFile, keyFile); err != nil {
-			logger.Error("websocket server error: %v", err)
+		err := server.ListenAndServeTLS(addr, certFile, keyFile)
+		if s.closing() {
+			return
 		}
+		logger.Error("websocket server error: %v", err)
+		logger.Warn("restart websocket server in 1 seconds...")
+		time.Sleep(time.Second)
+		s.EnableWSS(addr, certFile, keyFile)
 	}()
 }
 
 func (s *Server) EnableWebsite(addr string, certFile, keyFile string) {
+	mux := http.NewServeMux()
+	mux.Handle("/", http.FileServer(http.FS(website.ChatRoomFS)))
+	server := &http.Server{Addr: addr, Handler: mux}
+	if !s.serve("website", server) {
+		return
+	}
 	go func() {
-		defer func() {
-			logger.Warn("restart website server in 1 seconds...")
-			time.Sleep(time.Second)
-			s.EnableWebsite(addr, certFile, keyFile)
-		}()
-		http.Handle("/", http.FileServer(http.FS(website.ChatRoomFS)))
-		if err := http.ListenAndServeTLS(addr, certFile, keyFile, nil); err != nil {
-			logger.Error("website server error: %v", err)
+		err := server.ListenAndServeTLS(certFile, keyFile)
+		if s.closing() {
+			return
 		}
+		logger.Error("website server error: %v", err)
+		logger.Warn("restart website server in 1 seconds...")
+		time.Sleep(time.Second)
+		s.EnableWebsite(addr, certFile, keyFile)
 	}()
 }
 
-func (s *Server) ListenAndServe(addr string) {
+// ListenAndServe accept the TCP connections until the server is shut down,
+// then it returns ErrServerClosed
+func (s *Server) ListenAndServe(addr string) error {
 	ln, err := net.Listen("tcp", addr)
 	if err != nil {
-		logger.Panic("failed to listen the address: %v", err)
+		return err
 	}
 	defer ln.Close()
+	s.mu.Lock()
+	if s.closing() {
+		s.mu.Unlock()
+		return ErrServerClosed
+	}
+	s.listeners = append(s.listeners, ln)
+	s.mu.Unlock()
 	for {
 		c, err := ln.Accept()
 		if err != nil {
+			if s.closing() {
+				return ErrServerClosed
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
 			logger.Error("accept error: %v", err)
 			continue
 		}
-		go s.handle(&conn{Conn: c})
+		go s.handle(newConn(c), TransportTCP)
+	}
+}
+
+// Shutdown stop the listeners, wait for the connections to finish the frames they sent,
+// then close every connection with a notice once its queue is flushed.
+// The connections are closed anyway when ctx is done, and ctx's error is returned
+func (s *Server) Shutdown(ctx context.Context) (err error) {
+	s.mu.Lock()
+	if s.closing() {
+		s.mu.Unlock()
+		return ErrServerClosed
+	}
+	close(s.done)
+	for _, ln := range s.listeners {
+		ln.Close()
+	}
+	servers := s.servers
+	s.mu.Unlock()
+	for name, server := range servers {
+		if err := server.Shutdown(ctx); err != nil {
+			logger.Warn("failed to shut down the %s server: %v", name, err)
+		}
+	}
+	if s.cluster != nil {
+		s.cluster.close()
+	}
+
+	// stop reading, the read loops give up at the deadline
+	s.conns.Range(func(key, value any) bool {
+		key.(*conn).SetReadDeadline(time.Now())
+		return true
+	})
+	err = s.wait(ctx, &s.handlers)
+
+	s.conns.Range(func(key, value any) bool {
+		key.(*conn).goodbye("server shutdown")
+		return true
+	})
+	s.conns.Range(func(key, value any) bool {
+		conn := key.(*conn)
+		if ferr := conn.flush(ctx); ferr != nil && err == nil {
+			err = ferr
+		}
+		s.remove(conn)
+		return true
+	})
+	if s.journal != nil {
+		if err := s.journal.close(); err != nil {
+			logger.Error("failed to close the journal: %v", err)
+		}
+	}
+	return
+}
+
+// remove drop the connection from the registry once, the disconnect hooks only see
+// the connections which were welcomed
+func (s *Server) remove(conn *conn) {
+	if _, ok := s.conns.LoadAndDelete(conn); !ok {
+		return
 	}
+	s.registry.remove(conn)
+	s.forget(conn)
+	conn.Close()
+	if conn.welcome.Version > 0 {
+		s.hooks.disconnect(conn)
+	}
+}
+
+func (s *Server) closing() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// server the named server kept for the shutdown
+func (s *Server) server(name string) shutdowner {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.servers[name]
+}
+
+// serve keep the named server for the shutdown, it fails once the shutdown began
+func (s *Server) serve(name string, server shutdowner) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing() {
+		return false
+	}
+	s.servers[name] = server
+	return true
+}
+
+// enter count a goroutine into wg unless the shutdown began
+func (s *Server) enter(wg *sync.WaitGroup) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing() {
+		return false
+	}
+	wg.Add(1)
+	return true
 }
 
-func (s *Server) handle(conn *conn) {
-	defer _connlib.remove(conn)
+func (s *Server) wait(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *Server) handle(conn *conn, transport string) {
+	conn.transport, conn.metrics, conn.connected = transport, s.metrics, time.Now()
+	if !s.enter(&s.handlers) {
+		conn.Close()
+		return
+	}
+	s.conns.Store(conn, struct{}{})
+	conn.serve(s.queueSize, s.queuePolicy)
+	defer s.handlers.Done()
+	defer func() {
+		if !s.closing() && !s.park(conn) { // left to the shutdown otherwise
+			s.remove(conn)
+		}
+	}()
 
 	frame := &protocol.Frame{}
 	processor := protocol.NewFrameProcessor(conn)
 
 	// handshake
-	if err := s.handshake(processor, frame); err != nil {
+	if hello, err := s.handshake(processor, frame, conn); err != nil {
+		atomic.AddUint64(&s.metrics.handshakeFailures, 1)
 		logger.Error("verification failed: %v", err)
 		return
 	} else { // only response on a successful handshake
-		_connlib.register(conn)
-		if err := s.response(processor, frame, ""); err != nil {
+		parked := s.resumable(conn, hello)
+		if parked != nil {
+			conn.id = parked.id
+			conn.hold()
+		}
+		s.registry.register(conn)
+		if err := s.admit(conn, parked != nil); err != nil {
+			atomic.AddUint64(&s.metrics.handshakeFailures, 1)
+			logger.Warn("connection denied: %v", err)
+			if err := s.response(processor, frame, errorMessage(err, "connection denied")); err != nil {
+				logger.Error("failed to response: %v", err)
+			}
+			if parked != nil {
+				s.remove(parked)
+			}
+			return
+		}
+		if err := s.welcome(processor, frame, conn, hello, parked); err != nil {
 			logger.Error("failed to response: %v", err)
+			if parked != nil {
+				s.remove(parked)
+			}
 			return
 		}
+		atomic.StoreUint32(&conn.greeted, 1) // before the resumed labels, the connection is held
+		if parked != nil {
+			s.resume(conn, parked, hello.Received)
+		}
 	}
 
 	for {
-		err := processor.SetDecodeTimeout(ConnReadDuration)
+		err := processor.SetDecodeTimeout(conn.readTimeout())
 		if err != nil {
 			logger.Error("failed to set decode deadline: %v", err)
 			return
 		}
+		if s.closing() {
+			return
+		}
 		raw, err := processor.Decode(frame)
 		if err != nil {
 			logger.Error("failed to read next frame: %v", err)
 			return
 		}
+		conn.read(frame.Act, len(raw))
 		switch frame.Act {
 		case protocol.ActResponse:
 			// heartbeat
 		case protocol.ActMulticast:
-			s.multicast(frame.Label, raw)
+			ack := frame.Flags&protocol.FlagAck > 0
+			if err = s.publishable(conn, frame.Label); err == nil {
+				if err = s.hooks.multicast(conn, frame); err == nil {
+					// the hooks may have rewritten the label
+					if err = s.publishable(conn, frame.Label); err == nil {
+						err = s.multicast(frame, conn)
+					}
+				}
+			}
+			errMsg := ""
+			if err != nil {
+				logger.Warn("multicast dropped: %v", err)
+				errMsg = errorMessage(err, "multicast dropped")
+			}
+			if ack {
+				if err := s.response(processor, frame, errMsg); err != nil {
+					logger.Error("failed to response: %v", err)
+					return
+				}
+			}
+		case protocol.ActAck:
+			if seq, n := binary.Uvarint(frame.Payload); n > 0 && s.journal != nil && s.auth != nil {
+				s.journal.cursors.ack(conn.identity.ID, frame.Label, seq)
+			}
+		case protocol.ActClose:
+			logger.Info("connection closed by the client: %s", frame.Payload)
+			s.leave(conn)
+			ctx, cancel := context.WithTimeout(context.Background(), ConnWriteTimeout)
+			conn.flush(ctx) // the responses before the notice
+			cancel()
+			return
+		case protocol.ActUnicast:
+			ack := frame.Flags&protocol.FlagAck > 0
+			errMsg := ""
+			if err := s.unicast(frame, conn); err != nil {
+				logger.Warn("failed to unicast: %v", err)
+				errMsg = errorMessage(err, "unicast dropped")
+			}
+			if ack {
+				if err := s.response(processor, frame, errMsg); err != nil {
+					logger.Error("failed to response: %v", err)
+					return
+				}
+			}
 		case protocol.ActLabel:
-			if err := s.label(conn, frame.Label, frame.Payload); err != nil {
-				errMsg := "failed to (dis)label connection"
+			if err := s.label(conn, frame.Label, frame.Payload, frame.Flags&protocol.FlagNoEcho > 0); err != nil {
+				errMsg := errorMessage(err, "failed to (dis)label connection")
 				logger.Error("%s: %v %s %v", errMsg, err, frame.Label, frame.Payload)
 				if err := s.response(processor, frame, errMsg); err != nil {
 					logger.Error("failed to response: %v", err)
@@ -116,57 +477,453 @@ func (s *Server) handle(conn *conn) {
 	}
 }
 
+// publishable check the label a connection multicasts to against the patterns and the policy
+func (s *Server) publishable(conn *conn, label string) error {
+	if isPattern(label) {
+		return fmt.Errorf("%s is a pattern", label)
+	}
+	return s.policy.authorize(conn.identity, RightPublish, label)
+}
+
+// admit deny the banned identities, then run the connect hooks unless a session is resumed
+func (s *Server) admit(conn *conn, resumed bool) error {
+	if reason, ok := s.bans.Load(conn.identity.ID); ok {
+		return &protocol.Error{Code: protocol.CodeDenied, Message: "banned: " + reason.(string)}
+	}
+	if resumed {
+		return nil
+	}
+	return s.hooks.connect(conn)
+}
+
+// errorMessage the response payload of a typed error, the fallback hides any other error
+func errorMessage(err error, fallback string) string {
+	var typed *protocol.Error
+	if errors.As(err, &typed) {
+		return string(typed.Marshal())
+	}
+	return fallback
+}
+
 func (s *Server) response(processor *protocol.FrameProcessor, frame *protocol.Frame, errMsg string) (err error) {
 	frame.Act = protocol.ActResponse
+	frame.Flags = 0
 	frame.Label = ""
+	frame.Ext = nil
 	frame.Payload = []byte(errMsg)
 	return processor.Encode(frame)
 }
 
-func (s *Server) handshake(processor *protocol.FrameProcessor, frame *protocol.Frame) (err error) {
+// welcome answer the negotiated result, then switch to the chosen protocol version
+func (s *Server) welcome(processor *protocol.FrameProcessor, frame *protocol.Frame, conn *conn, hello *protocol.Hello, parked *conn) (err error) {
+	frame.Act = protocol.ActResponse
+	frame.Label = ""
+	frame.Payload = nil
+	var welcome protocol.Welcome
+	if hello.Legacy {
+		welcome = protocol.Welcome{Version: protocol.V1, MaxPayload: uint32(protocol.V1.MaxPayload())}
+	} else {
+		if welcome, err = s.negotiate(hello); err != nil {
+			return
+		}
+		welcome.ConnID = conn.id
+		s.open(conn, welcome.Version, parked)
+		welcome.Session, welcome.Resumed = conn.session, parked != nil
+		frame.Payload = welcome.Marshal()
+	}
+	// the answer itself still goes out in the legacy layout
+	if err = processor.Encode(frame); err != nil {
+		return
+	}
+	conn.welcome = welcome
+	processor.SetVersion(conn.welcome.Version)
+	processor.SetMaxPayload(int(conn.welcome.MaxPayload))
+	return
+}
+
+func (s *Server) negotiate(hello *protocol.Hello) (welcome protocol.Welcome, err error) {
+	if welcome.Version, err = protocol.Negotiate(hello.Versions); err != nil {
+		return
+	}
+	if welcome.Version > protocol.V1 {
+	COMPRESSION:
+		for _, c := range protocol.Compressions {
+			for _, o := range hello.Compressions {
+				if c == o {
+					welcome.Compression = c
+					break COMPRESSION
+				}
+			}
+		}
+	}
+	welcome.MaxPayload = uint32(welcome.Version.MaxPayload())
+	if hello.MaxPayload > 0 && hello.MaxPayload < welcome.MaxPayload {
+		welcome.MaxPayload = hello.MaxPayload
+	}
+	if MaxPayloadSize < welcome.MaxPayload {
+		welcome.MaxPayload = MaxPayloadSize
+	}
+	switch welcome.Heartbeat = hello.Heartbeat; {
+	case welcome.Heartbeat == 0:
+		welcome.Heartbeat = HeartbeatInterval
+	case welcome.Heartbeat < MinHeartbeatInterval:
+		welcome.Heartbeat = MinHeartbeatInterval
+	case welcome.Heartbeat > MaxHeartbeatInterval:
+		welcome.Heartbeat = MaxHeartbeatInterval
+	}
+	return
+}
+
+func (s *Server) handshake(processor *protocol.FrameProcessor, frame *protocol.Frame, conn *conn) (hello *protocol.Hello, err error) {
 	err = processor.SetDecodeTimeout(ConnReadDuration)
 	if err != nil {
 		return
 	}
-	_, err = processor.Decode(frame)
+	raw, err := processor.Decode(frame)
 	if err != nil {
 		return
 	}
-	if frame.Act != protocol.ActHandshake || !bytes.Equal(frame.Payload, []byte("sample_secret")) { // TODO
+	conn.read(frame.Act, len(raw))
+	if frame.Act != protocol.ActHandshake {
 		err = errors.New("illegal connection")
+		return
+	}
+	if hello, err = protocol.UnmarshalHello(frame.Payload); err != nil {
+		return
+	}
+	switch {
+	case s.auth == nil:
+		conn.identity = anonymousIdentity(conn.RemoteAddr())
+	case hello.Challenge:
+		err = s.challenge(processor, frame, conn, hello)
+	default:
+		if challenged(s.auth) && !s.clearSecret {
+			err = errors.New("the handshake needs the challenge")
+			break
+		}
+		conn.identity, err = s.auth.Authenticate(hello, conn.RemoteAddr())
+	}
+	if err != nil {
+		err = fmt.Errorf("illegal connection: %w", err)
 	}
 	return
 }
 
-func (s *Server) multicast(label string, data []byte) (err error) {
-	pool, err := _connlib.pool(label)
+// challenged whether the authenticator verifies a proof instead of the secret itself
+func challenged(auth Authenticator) bool {
+	switch auth.(type) {
+	case KeyAuthenticator, SaltedKeyAuthenticator:
+		return true
+	}
+	return false
+}
+
+// challenge ask the client to prove its secret with an HMAC of a one-off nonce,
+// plain authenticators ask for the secret itself instead
+func (s *Server) challenge(processor *protocol.FrameProcessor, frame *protocol.Frame, conn *conn, hello *protocol.Hello) (err error) {
+	challenge := &protocol.Challenge{}
+	var (
+		identity  *Identity
+		storedKey []byte
+		keyErr    error
+	)
+	saltedAuth, salted := s.auth.(SaltedKeyAuthenticator)
+	if salted {
+		identity, challenge.Salt, storedKey, keyErr = saltedAuth.SaltedKey(hello.ID, conn.RemoteAddr())
+	}
+	if challenged(s.auth) {
+		if challenge.Nonce, err = s.nonces.issue(); err != nil {
+			return
+		}
+	}
+	frame.Act = protocol.ActHandshake
+	frame.Label = ""
+	frame.Payload = challenge.Marshal()
+	if err = processor.Encode(frame); err != nil {
+		return
+	}
+	raw, err := processor.Decode(frame)
 	if err != nil {
 		return
 	}
-	go func() {
-		for current := pool.Entry(); current != nil; current = current.Next() {
-			current.Load().(*conn).Write(data)
+	conn.read(frame.Act, len(raw))
+	if frame.Act != protocol.ActHandshake {
+		return errors.New("challenge unanswered")
+	}
+	proof, err := protocol.UnmarshalProof(frame.Payload)
+	if err != nil {
+		return
+	}
+	if !challenged(s.auth) {
+		hello.Secret = proof.Secret
+		conn.identity, err = s.auth.Authenticate(hello, conn.RemoteAddr())
+		return
+	}
+	if !s.nonces.consume(challenge.Nonce) {
+		return errors.New("nonce expired or reused")
+	}
+	if skew := time.Since(proof.Time); skew > ChallengeSkew || skew < -ChallengeSkew {
+		return errors.New("proof out of the clock skew window")
+	}
+	if salted {
+		if keyErr != nil {
+			return keyErr
 		}
-	}()
+		if !proof.VerifySalted(storedKey, challenge.Nonce, hello.ID) {
+			return errBadCredentials
+		}
+		conn.identity = identity
+		return
+	}
+	identity, key, err := s.auth.(KeyAuthenticator).Key(hello.ID, conn.RemoteAddr())
+	if err != nil {
+		return
+	}
+	if !proof.Verify(key, challenge.Nonce, hello.ID) {
+		return errBadCredentials
+	}
+	conn.identity = identity
+	return
+}
+
+// multicast relay the frame stamped with the label sequence, server time and sender,
+// the connections speaking the legacy protocol receive it without the stamp
+func (s *Server) multicast(frame *protocol.Frame, from *conn) (err error) {
+	echo := frame.Flags&protocol.FlagNoEcho == 0 && !from.muted(frame.Label)
+	frame.Flags &^= protocol.FlagNoEcho | protocol.FlagAck
+	label := frame.Label
+	sequence, seq := s.sequence(label)
+	defer sequence.mu.Unlock()
+	s.stamp(frame, seq, from)
+	fanout := newFanout(frame, from)
+	if s.history != nil {
+		s.history.record(label, seq, fanout)
+	}
+	if s.journal != nil {
+		if err := s.journal.append(label, seq, fanout); err != nil {
+			logger.Error("failed to append the journal of %s: %v", label, err)
+		}
+	}
+	if s.cluster != nil {
+		s.cluster.forward(label, fanout)
+	}
+	if echo {
+		from = nil
+	}
+	start := time.Now()
+	undelivered := s.broadcast(label, seq, fanout, from)
+	s.metrics.fanout(time.Since(start))
+	if undelivered > 0 {
+		err = &protocol.Error{Code: protocol.CodeUndelivered, Message: fmt.Sprintf("%d members can not take it", undelivered)}
+	}
+	return
+}
+
+// relay deliver a frame forwarded by a peer node to the local members, stamped with the
+// label sequence of this node and recorded like a local multicast
+func (s *Server) relay(frame *protocol.Frame) {
+	label := frame.Label
+	sequence, seq := s.sequence(label)
+	defer sequence.mu.Unlock()
+	frame.SetUvarint(protocol.ExtSequence, seq)
+	fanout := newStoredFanout(frame, "")
+	if s.history != nil {
+		s.history.record(label, seq, fanout)
+	}
+	if s.journal != nil {
+		if err := s.journal.append(label, seq, fanout); err != nil {
+			logger.Error("failed to append the journal of %s: %v", label, err)
+		}
+	}
+	s.broadcast(label, seq, fanout, nil)
+}
+
+// broadcast queue the frame for every member but except in the caller's goroutine, so that the frames
+// a connection sends to a label reach every member in the order they are sent. It returns
+// the number of members the frame could not be encoded for
+func (s *Server) broadcast(label string, seq uint64, fanout *fanout, except *conn) (undelivered int) {
+	s.registry.members(label, func(conn *conn, pattern bool) {
+		if conn == except || !conn.welcomed() {
+			return
+		}
+		if pattern && s.policy.authorize(conn.identity, RightSubscribe, label) != nil {
+			return // a pattern does not grant more than the labels it matches
+		}
+		if pieces, err := fanout.encode(conn); err != nil {
+			logger.Warn("failed to relay frame to %s: %v", conn.RemoteAddr(), err)
+			undelivered++
+		} else {
+			for _, data := range pieces {
+				conn.deliver(label, seq, data)
+			}
+		}
+	})
+	return
+}
+
+// unicast deliver the frame to the target connection or every connection of the target user,
+// the receivers see the sender's connection as the label
+func (s *Server) unicast(frame *protocol.Frame, from *conn) (err error) {
+	connID, userID, err := parseTarget(frame.Label)
+	if err != nil {
+		return
+	}
+	var targets []*conn
+	if len(userID) > 0 {
+		if pool, err := s.registry.user(userID); err == nil {
+			for current := pool.Entry(); current != nil; current = current.Next() {
+				if target := current.Load().(*conn); target.welcomed() {
+					targets = append(targets, target)
+				}
+			}
+		}
+	} else if target, err := s.registry.conn(connID); err == nil && target.welcomed() {
+		targets = append(targets, target)
+	}
+	if len(targets) == 0 {
+		return &protocol.Error{Code: protocol.CodeUndelivered, Message: "no such target: " + frame.Label}
+	}
+	frame.Flags &^= protocol.FlagAck
+	frame.Label = ConnTarget(from.id)
+	s.stamp(frame, 0, from)
+	fanout := newFanout(frame, from)
+	undelivered := 0
+	for _, target := range targets {
+		if pieces, err := fanout.encode(target); err != nil {
+			logger.Warn("failed to relay frame to %s: %v", target.RemoteAddr(), err)
+			undelivered++
+		} else {
+			for _, data := range pieces {
+				target.deliver("", 0, data)
+			}
+		}
+	}
+	if undelivered > 0 {
+		err = &protocol.Error{Code: protocol.CodeUndelivered, Message: fmt.Sprintf("%d targets can not take it", undelivered)}
+	}
+	return
+}
+
+// labelSequence the last sequence number of a label, mu is held from taking a number until
+// the frame is recorded and queued for the members, so that they get the frames in sequence
+type labelSequence struct {
+	last uint64
+	mu   sync.Mutex
+}
+
+// sequence lock the label and take its next sequence number, starting from 1,
+// the caller unlocks the returned sequence
+func (s *Server) sequence(label string) (*labelSequence, uint64) {
+	v, ok := s.sequences.Load(label)
+	if !ok {
+		v, _ = s.sequences.LoadOrStore(label, &labelSequence{})
+	}
+	sequence := v.(*labelSequence)
+	sequence.mu.Lock()
+	sequence.last++
+	return sequence, sequence.last
+}
+
+// stamp replace the extensions sent by the client with the delivery metadata, but the message ID
+func (s *Server) stamp(frame *protocol.Frame, seq uint64, from *conn) {
+	id, _ := frame.Extension(protocol.ExtMessageID)
+	frame.Ext = nil
+	frame.Stamp(seq, time.Now(), from.id, from.identity.ID)
+	if len(id) > 0 {
+		frame.SetExtension(protocol.ExtMessageID, id)
+	}
+}
+
+// join label the connection, with a replay after the explicit since,
+// or after the acknowledged cursor of an authenticated identity
+func (s *Server) join(conn *conn, label string, since uint64, explicit bool) error {
+	if err := s.policy.authorize(conn.identity, RightSubscribe, label); err != nil {
+		return err
+	}
+	if err := s.hooks.label(conn, label); err != nil {
+		return err
+	}
+	if isPattern(label) { // no history for the patterns
+		return s.registry.label(conn, label)
+	}
+	if !explicit && s.journal != nil && s.auth != nil {
+		since, explicit = s.journal.cursors.cursor(conn.identity.ID, label)
+	}
+	if explicit && (s.history != nil || s.journal != nil) {
+		return s.replay(conn, label, since)
+	}
+	return s.registry.label(conn, label)
+}
+
+func (s *Server) dislabel(conn *conn, label string) error {
+	if err := s.hooks.dislabel(conn, label); err != nil {
+		return err
+	}
+	if err := s.registry.dislabel(conn, label); err != nil {
+		return err
+	}
+	conn.mute(label, false)
+	return nil
+}
+
+// replay label the connection, then deliver the history of the label after since
+// before any live traffic
+func (s *Server) replay(conn *conn, label string, since uint64) (err error) {
+	conn.hold()
+	var last uint64
+	defer func() { conn.release(label, last) }()
+	if err = s.registry.label(conn, label); err != nil {
+		return
+	}
+	deliver := func(rec *record) bool {
+		pieces, encodeErr := rec.fanout.encode(conn)
+		if encodeErr != nil {
+			logger.Warn("failed to replay frame to %s: %v", conn.RemoteAddr(), encodeErr)
+		}
+		for _, data := range pieces {
+			if _, err = conn.Write(data); err != nil {
+				return false
+			}
+		}
+		last = rec.seq
+		return true
+	}
+	if s.journal != nil {
+		// streamed, the journal may keep far more than fits in memory
+		if readErr := s.journal.since(label, since, deliver); readErr != nil {
+			logger.Error("failed to read the journal of %s: %v", label, readErr)
+		}
+		return
+	}
+	for _, rec := range s.history.since(label, since) {
+		if !deliver(rec) {
+			return
+		}
+	}
 	return
 }
 
-func (s *Server) label(conn *conn, label string, payload []byte) (err error) {
+// label quiet is whether the connection leaves itself out of its multicasts to the joined labels
+func (s *Server) label(conn *conn, label string, payload []byte, quiet bool) (err error) {
 	if len(payload) > 0 {
 		switch payload[0] {
 		case '+':
-			err = _connlib.label(conn, label)
+			since, n := binary.Uvarint(payload[1:])
+			if err = s.join(conn, label, since, n > 0); err == nil {
+				conn.mute(label, quiet)
+			}
 		case '*':
 			for _, l := range strings.Split(label, "|") {
-				if err = _connlib.label(conn, l); err != nil {
+				if err = s.join(conn, l, 0, false); err != nil {
 					break
 				}
+				conn.mute(l, quiet)
 			}
 		case '-':
-			err = _connlib.dislabel(conn, label)
+			err = s.dislabel(conn, label)
 		case '/':
 			for _, l := range strings.Split(label, "|") {
-				if err = _connlib.dislabel(conn, l); err != nil {
+				if err = s.dislabel(conn, l); err != nil {
 					break
 				}
 			}
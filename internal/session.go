@@ -0,0 +1,217 @@
+package internal
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/NanoRed/lim/internal/protocol"
+	"github.com/NanoRed/lim/pkg/logger"
+)
+
+// sessions the connections by session token, a broken one is parked to wait for its client to resume
+type sessions struct {
+	grace time.Duration
+	size  int // of the backlog of every connection
+	conns map[string]*conn
+	mu    sync.Mutex
+}
+
+// backlog the last relayed frames written to the connection of a session,
+// so that a resuming client gets the ones it did not receive
+type backlog struct {
+	size   int
+	sent   uint64   // the relayed frames written
+	frames [][]byte // the last size of them
+	unsent [][]byte // the ones failed to be written
+	mu     sync.Mutex
+}
+
+func (b *backlog) keep(data []byte, written bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !written {
+		b.unsent = append(b.unsent, data)
+		return
+	}
+	b.sent++
+	if b.frames = append(b.frames, data); len(b.frames) > b.size {
+		b.frames = b.frames[1:]
+	}
+}
+
+// since the frames after the received ones, false when some of them are gone
+func (b *backlog) since(received uint64) ([][]byte, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if received > b.sent || b.sent-received > uint64(len(b.frames)) {
+		return nil, false
+	}
+	frames := append([][]byte{}, b.frames[len(b.frames)-int(b.sent-received):]...)
+	return append(frames, b.unsent...), true
+}
+
+// EnableSessions give every v2 connection a session token in the welcome. A connection that
+// breaks keeps its labels for grace, collecting up to size frames, and a client resuming it
+// with the token gets what it missed in order without labeling again
+func (s *Server) EnableSessions(grace time.Duration, size int) {
+	s.sessions = &sessions{grace: grace, size: size, conns: make(map[string]*conn)}
+}
+
+// open give the connection a session, the one of the resumed connection if any
+func (s *Server) open(conn *conn, version protocol.Version, resumed *conn) {
+	if s.sessions == nil || version < protocol.V2 {
+		return
+	}
+	if resumed != nil {
+		conn.session = resumed.session
+	} else {
+		token := make([]byte, 16)
+		if _, err := rand.Read(token); err != nil {
+			logger.Error("failed to issue a session token: %v", err)
+			return
+		}
+		conn.session = hex.EncodeToString(token)
+	}
+	conn.backlog = &backlog{size: s.sessions.size}
+	conn.parked = make(chan struct{})
+	s.sessions.mu.Lock()
+	s.sessions.conns[conn.session] = conn
+	s.sessions.mu.Unlock()
+}
+
+// park keep the broken connection registered until it is resumed or the grace period ends,
+// false when it has no session to keep
+func (s *Server) park(conn *conn) bool {
+	if s.sessions == nil || len(conn.session) == 0 {
+		return false
+	}
+	if _, ok := s.conns.Load(conn); !ok { // kicked
+		return false
+	}
+	conn.Close()
+	<-conn.stopped // the backlog is complete once the writer exits
+	conn.park(s.sessions.size)
+	close(conn.parked)
+	time.AfterFunc(s.sessions.grace, func() {
+		if s.expire(conn) {
+			s.remove(conn)
+		}
+	})
+	return true
+}
+
+// expire take the parked connection out of the sessions at the end of its grace period, false
+// when it has been resumed, and the session may belong to the connection resuming it by now
+func (s *Server) expire(conn *conn) bool {
+	s.sessions.mu.Lock()
+	defer s.sessions.mu.Unlock()
+	if s.sessions.conns[conn.session] != conn {
+		return false
+	}
+	delete(s.sessions.conns, conn.session)
+	return true
+}
+
+// claim take the parked connection of the session out of the sessions for the resumer of
+// the same identity, the token alone stands for an anonymous client whose address changes
+// on reconnecting. A connection not parked yet is closed for the resumer, since its client
+// may notice the break earlier than the server
+func (s *Server) claim(session string, resumer *conn) *conn {
+	s.sessions.mu.Lock()
+	defer s.sessions.mu.Unlock()
+	conn, ok := s.sessions.conns[session]
+	if !ok || !sameIdentity(conn.identity, resumer.identity) {
+		return nil
+	}
+	select {
+	case <-conn.parked:
+	default:
+		s.sessions.mu.Unlock()
+		conn.Close()
+		select {
+		case <-conn.parked:
+		case <-time.After(ConnWriteTimeout):
+		}
+		s.sessions.mu.Lock()
+		if s.sessions.conns[session] != conn {
+			return nil
+		}
+		select {
+		case <-conn.parked:
+		default:
+			return nil
+		}
+	}
+	delete(s.sessions.conns, session)
+	return conn
+}
+
+// forget drop the session of the removed connection
+func (s *Server) forget(conn *conn) {
+	if s.sessions == nil || len(conn.session) == 0 {
+		return
+	}
+	s.sessions.mu.Lock()
+	if s.sessions.conns[conn.session] == conn {
+		delete(s.sessions.conns, conn.session)
+	}
+	s.sessions.mu.Unlock()
+}
+
+// leave end the session of the connection closed by its client, so that it is not parked
+func (s *Server) leave(conn *conn) {
+	s.forget(conn)
+	conn.session = ""
+}
+
+// resumable the parked connection the hello asks to resume, it is removed instead
+// when the frames the client did not receive are no longer kept
+func (s *Server) resumable(conn *conn, hello *protocol.Hello) *conn {
+	if s.sessions == nil || len(hello.Session) == 0 {
+		return nil
+	}
+	if version, _ := protocol.Negotiate(hello.Versions); version < protocol.V2 {
+		return nil
+	}
+	parked := s.claim(hello.Session, conn)
+	if parked == nil {
+		return nil
+	}
+	if _, ok := s.conns.Load(parked); !ok || parked.overflowed() {
+		s.remove(parked)
+		return nil
+	}
+	if _, ok := parked.backlog.since(hello.Received); !ok {
+		s.remove(parked)
+		return nil
+	}
+	return parked
+}
+
+// resume move the labels of the parked connection to the welcomed one, which is held
+// since its registration, then deliver what the client missed before the live traffic
+func (s *Server) resume(conn *conn, parked *conn, received uint64) {
+	for _, label := range s.registry.joined(parked) {
+		if err := s.registry.label(conn, label); err != nil {
+			logger.Warn("failed to resume label %s: %v", label, err)
+		}
+	}
+	parked.quiet.Range(func(key, value any) bool {
+		conn.quiet.Store(key, value)
+		return true
+	})
+	s.conns.Delete(parked)
+	s.registry.remove(parked)
+	missed, _ := parked.backlog.since(received)
+	conn.backlog.sent = received // the count goes on through the session
+	conn.takeover(parked, missed)
+}
+
+func sameIdentity(a, b *Identity) bool {
+	if a.anonymous || b.anonymous {
+		return a.anonymous && b.anonymous
+	}
+	return a.ID == b.ID
+}
@@ -0,0 +1,198 @@
+package internal
+
+import (
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/NanoRed/lim/pkg/container"
+)
+
+// the tokens of the pattern labels, which are split by '.',
+// '*' matches exactly one token and a trailing '>' matches one or more
+const (
+	tokenSeparator = "."
+	tokenOne       = "*"
+	tokenMore      = ">"
+)
+
+func isPattern(label string) bool {
+	for _, token := range strings.Split(label, tokenSeparator) {
+		if token == tokenOne || token == tokenMore {
+			return true
+		}
+	}
+	return false
+}
+
+func validPattern(pattern string) error {
+	tokens := strings.Split(pattern, tokenSeparator)
+	for i, token := range tokens {
+		if token == tokenMore && i != len(tokens)-1 {
+			return errors.New("'>' must be the last token of a pattern")
+		}
+	}
+	return nil
+}
+
+// matchPattern whether the label is one of the pattern
+func matchPattern(pattern, label string) bool {
+	ptokens, ltokens := strings.Split(pattern, tokenSeparator), strings.Split(label, tokenSeparator)
+	for i, ptoken := range ptokens {
+		switch {
+		case ptoken == tokenMore:
+			return len(ltokens) > i
+		case i >= len(ltokens):
+			return false
+		case ptoken != tokenOne && ptoken != ltokens[i]:
+			return false
+		}
+	}
+	return len(ptokens) == len(ltokens)
+}
+
+// trie the index of the pattern subscriptions, every pattern ends at a node
+// holding the pool of its members
+type trie struct {
+	root  *trieNode
+	count int
+	rwmu  sync.RWMutex
+}
+
+type trieNode struct {
+	children map[string]*trieNode
+	pool     *pool
+}
+
+func newTrie() *trie {
+	return &trie{root: &trieNode{children: make(map[string]*trieNode)}}
+}
+
+func (t *trie) add(pattern string, conn *conn) *container.SyncPoolNode {
+	t.rwmu.Lock()
+	defer t.rwmu.Unlock()
+	node := t.root
+	for _, token := range strings.Split(pattern, tokenSeparator) {
+		child, ok := node.children[token]
+		if !ok {
+			child = &trieNode{children: make(map[string]*trieNode)}
+			node.children[token] = child
+		}
+		node = child
+	}
+	if node.pool == nil {
+		node.pool = &pool{SyncPool: container.NewSyncPool()}
+		t.count++
+	}
+	return node.pool.Add(conn)
+}
+
+// remove drop the member from the pattern, the nodes left without any pool are pruned
+func (t *trie) remove(pattern string, member *container.SyncPoolNode) {
+	t.rwmu.Lock()
+	defer t.rwmu.Unlock()
+	tokens := strings.Split(pattern, tokenSeparator)
+	path := []*trieNode{t.root}
+	for _, token := range tokens {
+		child, ok := path[len(path)-1].children[token]
+		if !ok {
+			return
+		}
+		path = append(path, child)
+	}
+	node := path[len(path)-1]
+	if node.pool == nil {
+		return
+	}
+	node.pool.Remove(member)
+	if node.pool.Entry() != nil {
+		return
+	}
+	node.pool = nil
+	t.count--
+	for i := len(tokens) - 1; i >= 0; i-- {
+		if node := path[i+1]; node.pool != nil || len(node.children) > 0 {
+			break
+		}
+		delete(path[i].children, tokens[i])
+	}
+}
+
+// has whether the pattern has members
+func (t *trie) has(pattern string) bool {
+	t.rwmu.RLock()
+	defer t.rwmu.RUnlock()
+	node := t.root
+	for _, token := range strings.Split(pattern, tokenSeparator) {
+		if node = node.children[token]; node == nil {
+			return false
+		}
+	}
+	return node.pool != nil
+}
+
+// size the members of the pattern
+func (t *trie) size(pattern string) (n int) {
+	t.rwmu.RLock()
+	defer t.rwmu.RUnlock()
+	node := t.root
+	for _, token := range strings.Split(pattern, tokenSeparator) {
+		if node = node.children[token]; node == nil {
+			return
+		}
+	}
+	if node.pool != nil {
+		for current := node.pool.Entry(); current != nil; current = current.Next() {
+			n++
+		}
+	}
+	return
+}
+
+// match the pools of every pattern matching the label
+func (t *trie) match(label string) (pools []*pool) {
+	t.rwmu.RLock()
+	defer t.rwmu.RUnlock()
+	if t.count == 0 {
+		return
+	}
+	var walk func(node *trieNode, tokens []string)
+	walk = func(node *trieNode, tokens []string) {
+		if len(tokens) == 0 {
+			if node.pool != nil {
+				pools = append(pools, node.pool)
+			}
+			return
+		}
+		if child := node.children[tokenMore]; child != nil && child.pool != nil {
+			pools = append(pools, child.pool)
+		}
+		if child := node.children[tokenOne]; child != nil {
+			walk(child, tokens[1:])
+		}
+		if tokens[0] != tokenOne {
+			if child := node.children[tokens[0]]; child != nil {
+				walk(child, tokens[1:])
+			}
+		}
+	}
+	walk(t.root, strings.Split(label, tokenSeparator))
+	return
+}
+
+// patterns every pattern with members
+func (t *trie) patterns() (patterns []string) {
+	t.rwmu.RLock()
+	defer t.rwmu.RUnlock()
+	var walk func(node *trieNode, prefix []string)
+	walk = func(node *trieNode, prefix []string) {
+		if node.pool != nil {
+			patterns = append(patterns, strings.Join(prefix, tokenSeparator))
+		}
+		for token, child := range node.children {
+			walk(child, append(prefix[:len(prefix):len(prefix)], token))
+		}
+	}
+	walk(t.root, nil)
+	return
+}
@@ -1,23 +1,25 @@
 package websocket
 
 import (
+	"context"
 	"net"
 	"net/http"
+	"sync/atomic"
 
 	"github.com/NanoRed/lim/pkg/logger"
 	"github.com/gorilla/websocket"
 )
 
 type Server struct {
-	handle func(conn net.Conn)
+	handle   func(conn net.Conn)
+	server   *http.Server
+	upgrades uint64
+	failures uint64
 }
 
 func NewServer(handle func(conn net.Conn)) *Server {
-	return &Server{handle}
-}
-
-func (s *Server) ListenAndServeTLS(addr string, certFile, keyFile string) (err error) {
-	return http.ListenAndServeTLS(addr, certFile, keyFile, http.HandlerFunc(func(wt http.ResponseWriter, r *http.Request) {
+	s := &Server{handle: handle}
+	s.server = &http.Server{Handler: http.HandlerFunc(func(wt http.ResponseWriter, r *http.Request) {
 		var upgrader = websocket.Upgrader{
 			CheckOrigin: func(r *http.Request) bool {
 				return true
@@ -25,9 +27,27 @@ func (s *Server) ListenAndServeTLS(addr string, certFile, keyFile string) (err e
 		}
 		c, err := upgrader.Upgrade(wt, r, nil)
 		if err != nil {
+			atomic.AddUint64(&s.failures, 1)
 			logger.Error("websocket upgrade error: %v", err)
 			return
 		}
+		atomic.AddUint64(&s.upgrades, 1)
 		s.handle(newConn(c))
-	}))
+	})}
+	return s
+}
+
+func (s *Server) ListenAndServeTLS(addr string, certFile, keyFile string) (err error) {
+	s.server.Addr = addr
+	return s.server.ListenAndServeTLS(certFile, keyFile)
+}
+
+// Stats the counts of the successful and failed upgrades
+func (s *Server) Stats() (upgrades, failures uint64) {
+	return atomic.LoadUint64(&s.upgrades), atomic.LoadUint64(&s.failures)
+}
+
+// Shutdown stop accepting upgrades, the upgraded connections are left to their handle
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.server.Shutdown(ctx)
 }
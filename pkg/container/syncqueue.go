@@ -31,7 +31,7 @@ func (s *SyncQueue) Push(value any) {
 	newNode := &syncQueueNode{value: value}
 	for {
 		headNode := atomic.LoadPointer(&s.head)
-		if (*syncQueueNode)(headNode).next != nil &&
+		if atomic.LoadPointer(&(*syncQueueNode)(headNode).next) != nil &&
 			atomic.CompareAndSwapPointer(&s.head, headNode, unsafe.Pointer(newNode)) {
 			atomic.StorePointer(&(*syncQueueNode)(headNode).next, unsafe.Pointer(newNode))
 			atomic.StorePointer(&newNode.next, unsafe.Pointer(s))
@@ -50,14 +50,13 @@ func (s *SyncQueue) Pop() (value any) {
 		tailNext := atomic.LoadPointer(&tailNode.next)
 		if tailNext == unsafe.Pointer(s) {
 			<-s.block
-		} else if (*syncQueueNode)(tailNext).next == nil ||
-			(*syncQueueNode)(tailNext).next == unsafe.Pointer(s) {
+		} else if next := atomic.LoadPointer(&(*syncQueueNode)(tailNext).next); next == nil || next == unsafe.Pointer(s) {
 			if atomic.CompareAndSwapPointer(&s.head, tailNext, s.tail) {
 				atomic.CompareAndSwapPointer(&tailNode.next, tailNext, unsafe.Pointer(s))
 				value = (*syncQueueNode)(tailNext).value
 				return
 			}
-		} else if atomic.CompareAndSwapPointer(&tailNode.next, tailNext, (*syncQueueNode)(tailNext).next) {
+		} else if atomic.CompareAndSwapPointer(&tailNode.next, tailNext, next) {
 			value = (*syncQueueNode)(tailNext).value
 			return
 		}